@@ -1,12 +1,15 @@
 package api
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/viliproject/vili/environments"
 	"github.com/viliproject/vili/errors"
 	"github.com/viliproject/vili/middleware"
+	"github.com/viliproject/vili/rbac"
 	"github.com/viliproject/vili/server"
+	"github.com/viliproject/vili/session"
 	"github.com/labstack/echo"
 )
 
@@ -24,55 +27,73 @@ func AddHandlers(s *server.Server) {
 	s.Echo().GET(envPrefix+"deployments/:deployment/repository", envMiddleware(deploymentRepositoryGetHandler))
 	s.Echo().GET(envPrefix+"deployments/:deployment/spec", envMiddleware(deploymentSpecGetHandler))
 	s.Echo().GET(envPrefix+"deployments/:deployment/service", envMiddleware(deploymentServiceGetHandler))
-	s.Echo().POST(envPrefix+"deployments/:deployment/service", envMiddleware(deploymentServiceCreateHandler))
-	s.Echo().PUT(envPrefix+"deployments/:deployment/:action", envMiddleware(deploymentActionHandler))
+	s.Echo().POST(envPrefix+"deployments/:deployment/service", envMiddleware(requireAction(rbac.ActionRollout, deploymentServiceCreateHandler)))
+	s.Echo().PUT(envPrefix+"deployments/:deployment/:action", envMiddleware(requireAction(rbac.ActionRollout, deploymentActionHandler)))
 
 	// rollouts
-	s.Echo().POST(envPrefix+"deployments/:deployment/rollouts", envMiddleware(rolloutCreateHandler))
+	s.Echo().GET(envPrefix+"deployments/:deployment/rollouts", envMiddleware(rolloutsGetHandler))
+	s.Echo().GET(envPrefix+"deployments/:deployment/rollouts/:rollout", envMiddleware(rolloutGetHandler))
+	s.Echo().POST(envPrefix+"deployments/:deployment/rollouts", envMiddleware(requireAction(rbac.ActionRollout, rolloutCreateHandler)))
+	s.Echo().PUT(envPrefix+"deployments/:deployment/rollouts/:rollout/abort", envMiddleware(requireAction(rbac.ActionRollout, rolloutAbortHandler)))
 
 	// replica sets
 	s.Echo().GET(envPrefix+"replicasets", envMiddleware(replicaSetsGetHandler))
 
 	// jobs
 	s.Echo().GET(envPrefix+"jobs", envMiddleware(jobsGetHandler))
-	s.Echo().DELETE(envPrefix+"jobs/:job", envMiddleware(jobDeleteHandler))
+	s.Echo().DELETE(envPrefix+"jobs/:job", envMiddleware(requireAction(rbac.ActionRollout, jobDeleteHandler)))
 	s.Echo().GET(envPrefix+"jobs/:job/repository", envMiddleware(jobRepositoryGetHandler))
 	s.Echo().GET(envPrefix+"jobs/:job/spec", envMiddleware(jobSpecGetHandler))
 
 	// runs
-	s.Echo().POST(envPrefix+"jobs/:job/runs", envMiddleware(jobRunCreateHandler))
-	// s.Echo().GET(envPrefix+"jobs/:job/runs", envMiddleware(jobRunsGetHandler))
-	// s.Echo().POST(envPrefix+"jobs/:job/runs/:run/:action", envMiddleware(jobRunActionHandler))
+	s.Echo().POST(envPrefix+"jobs/:job/runs", envMiddleware(requireAction(rbac.ActionRollout, jobRunCreateHandler)))
+	s.Echo().GET(envPrefix+"jobs/:job/runs", envMiddleware(jobRunsGetHandler))
+	s.Echo().GET(envPrefix+"jobs/:job/runs/:run", envMiddleware(jobRunGetHandler))
+	s.Echo().PUT(envPrefix+"jobs/:job/runs/:run/:action", envMiddleware(requireAction(rbac.ActionRollout, jobRunActionHandler)))
+
+	// cron jobs
+	s.Echo().GET(envPrefix+"cronjobs", envMiddleware(cronJobsGetHandler))
+	s.Echo().GET(envPrefix+"cronjobs/:cronjob/repository", envMiddleware(cronJobRepositoryGetHandler))
+	s.Echo().GET(envPrefix+"cronjobs/:cronjob/spec", envMiddleware(cronJobSpecGetHandler))
+	s.Echo().PUT(envPrefix+"cronjobs/:cronjob/:action", envMiddleware(requireAction(rbac.ActionRollout, cronJobActionHandler)))
 
 	// functions
 	s.Echo().GET(envPrefix+"functions", envMiddleware(functionsGetHandler))
 	s.Echo().GET(envPrefix+"functions/:function/repository", envMiddleware(functionRepositoryGetHandler))
 	s.Echo().GET(envPrefix+"functions/:function/spec", envMiddleware(functionSpecGetHandler))
-	s.Echo().PUT(envPrefix+"functions/:function/:action", envMiddleware(functionActionHandler))
+	s.Echo().PUT(envPrefix+"functions/:function/:action", envMiddleware(requireAction(rbac.ActionRollout, functionActionHandler)))
 
 	// configmaps
 	s.Echo().GET(envPrefix+"configmaps", envMiddleware(configmapsGetHandler))
 	s.Echo().GET(envPrefix+"configmaps/:configmap/spec", envMiddleware(configmapSpecGetHandler))
-	s.Echo().POST(envPrefix+"configmaps/:configmap", envMiddleware(configmapCreateHandler))
-	s.Echo().DELETE(envPrefix+"configmaps/:configmap", envMiddleware(configmapDeleteHandler))
-	s.Echo().PUT(envPrefix+"configmaps/:configmap/keys", envMiddleware(configmapSetKeysHandler))
-	s.Echo().DELETE(envPrefix+"configmaps/:configmap/:key", envMiddleware(configmapDeleteKeyHandler))
+	s.Echo().POST(envPrefix+"configmaps/:configmap", envMiddleware(requireAction(rbac.ActionConfigMapEdit, configmapCreateHandler)))
+	s.Echo().DELETE(envPrefix+"configmaps/:configmap", envMiddleware(requireAction(rbac.ActionConfigMapEdit, configmapDeleteHandler)))
+	s.Echo().PUT(envPrefix+"configmaps/:configmap/keys", envMiddleware(requireAction(rbac.ActionConfigMapEdit, configmapSetKeysHandler)))
+	s.Echo().DELETE(envPrefix+"configmaps/:configmap/:key", envMiddleware(requireAction(rbac.ActionConfigMapEdit, configmapDeleteKeyHandler)))
 
 	// pods
 	s.Echo().GET(envPrefix+"pods", envMiddleware(podsHandler))
 	s.Echo().GET(envPrefix+"pods/:pod/log", envMiddleware(podLogHandler))
-	s.Echo().DELETE(envPrefix+"pods/:pod", envMiddleware(podDeleteHandler))
+	s.Echo().DELETE(envPrefix+"pods/:pod", envMiddleware(requireAction(rbac.ActionRollout, podDeleteHandler)))
 
 	// nodes
 	s.Echo().GET(envPrefix+"nodes", envMiddleware(nodesGetHandler))
-	s.Echo().PUT(envPrefix+"nodes/:node/:state", envMiddleware(nodeStateEditHandler))
+	s.Echo().PUT(envPrefix+"nodes/:node/:state", envMiddleware(requireAction(rbac.ActionNodeState, nodeStateEditHandler)))
 
 	// releases
 	s.Echo().GET(envPrefix+"releases", envMiddleware(releasesGetHandler))
 	s.Echo().GET(envPrefix+"releases/spec", envMiddleware(releaseSpecGetHandler))
-	s.Echo().POST(envPrefix+"releases", envMiddleware(releaseCreateHandler))
-	s.Echo().DELETE(envPrefix+"releases/:release", envMiddleware(releaseDeleteHandler))
-	s.Echo().PUT(envPrefix+"releases/:release/deploy", envMiddleware(releaseDeployHandler))
+	s.Echo().POST(envPrefix+"releases", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseCreateHandler)))
+	s.Echo().POST(envPrefix+"releases/validate", envMiddleware(releaseValidateHandler))
+	s.Echo().DELETE(envPrefix+"releases/:release", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseDeleteHandler)))
+	s.Echo().PUT(envPrefix+"releases/:release/deploy", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseDeployHandler)))
+	s.Echo().GET(envPrefix+"releases/:release/diff", envMiddleware(releaseDiffHandler))
+	s.Echo().GET(envPrefix+"releases/:release/notes", envMiddleware(releaseNotesGetHandler))
+	s.Echo().PUT(envPrefix+"releases/:release/rollback", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseRollbackHandler)))
+	s.Echo().POST(envPrefix+"releases/:release/schedules", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseScheduleCreateHandler)))
+	s.Echo().GET(envPrefix+"releaseschedules", envMiddleware(releaseSchedulesGetHandler))
+	s.Echo().DELETE(envPrefix+"releaseschedules/:schedule", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseScheduleDeleteHandler)))
+	s.Echo().PUT(envPrefix+"releases/:release/rollouts/:rollout/approve", envMiddleware(requireAction(rbac.ActionReleaseDeploy, releaseWaveApproveHandler)))
 
 	// branches
 	s.Echo().GET("/api/v1/branches", middleware.RequireUser(branchesGetHandler))
@@ -80,7 +101,7 @@ func AddHandlers(s *server.Server) {
 	// environments
 	s.Echo().GET("/api/v1/environments", middleware.RequireUser(environmentsGetHandler))
 	s.Echo().POST("/api/v1/environments", middleware.RequireUser(environmentCreateHandler))
-	s.Echo().DELETE("/api/v1/environments/:env", middleware.RequireUser(environmentDeleteHandler))
+	s.Echo().DELETE("/api/v1/environments/:env", middleware.RequireUser(requireAction(rbac.ActionEnvironmentDelete, environmentDeleteHandler)))
 	s.Echo().GET("/api/v1/environments/spec", middleware.RequireUser(environmentSpecHandler))
 
 	// catchall not found handler
@@ -92,10 +113,25 @@ func envMiddleware(h echo.HandlerFunc) echo.HandlerFunc {
 		if _, err := environments.Get(c.Param("env")); err != nil {
 			return notFoundHandler(c)
 		}
-		return h(c)
+		return requireAction(rbac.ActionView, h)(c)
 	})
 }
 
+// requireAction returns a forbidden error response if the user is not allowed
+// to perform the given action in the requested environment
+func requireAction(action rbac.Action, h echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		env := c.Param("env")
+		user := c.Get("user").(*session.User)
+		if !rbac.Can(user, env, action) {
+			return server.ErrorResponse(c, errors.Forbidden(
+				fmt.Sprintf("User %s is not allowed to %s in %s", user.Username, action, env),
+			))
+		}
+		return h(c)
+	}
+}
+
 func notFoundHandler(c echo.Context) error {
 	return server.ErrorResponse(c, errors.NotFound(""))
 }
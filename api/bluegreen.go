@@ -0,0 +1,427 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/viliproject/vili/config"
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/server"
+	"github.com/viliproject/vili/session"
+	"github.com/labstack/echo"
+	corev1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	colorLabel = "color"
+	colorBlue  = "blue"
+	colorGreen = "green"
+
+	// blueGreenScaleDownInterval is how often every replica checks for
+	// previous colors whose keep time has passed
+	blueGreenScaleDownInterval = 30 * time.Second
+)
+
+// RolloutBlueGreen configures a blue/green rollout, which deploys the new tag
+// as a parallel deployment and switches the service over once it is available
+type RolloutBlueGreen struct {
+	KeepTime      string `json:"keepTime"`
+	Color         string `json:"color"`
+	PreviousColor string `json:"previousColor,omitempty"`
+
+	keepDuration time.Duration
+}
+
+func otherColor(color string) string {
+	if color == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+func blueGreenDeploymentName(deploymentName, color string) string {
+	if color == "" {
+		return deploymentName
+	}
+	return deploymentName + "-" + color
+}
+
+// getBlueGreenDeployment returns the deployment of the given color, which is
+// either <name>-<color>, or the original <name> deployment that was labeled
+// with the color by its first blue/green rollout. It returns nil if there is
+// none.
+func getBlueGreenDeployment(env, deploymentName, color string) (*extv1beta1.Deployment, error) {
+	endpoint := kube.GetClient(env).Deployments()
+	for _, name := range []string{blueGreenDeploymentName(deploymentName, color), deploymentName} {
+		deployment, err := endpoint.Get(name, metav1.GetOptions{})
+		if err != nil {
+			if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if deployment.Spec.Template.ObjectMeta.Labels[colorLabel] == color {
+			return deployment, nil
+		}
+	}
+	return nil, nil
+}
+
+// initBlueGreen validates the blue/green configuration, picks the color for the
+// new deployment and sets the live deployment as the deployment rolled out from
+func (r *Rollout) initBlueGreen() error {
+	if r.BlueGreen == nil {
+		r.BlueGreen = &RolloutBlueGreen{}
+	}
+	if r.BlueGreen.KeepTime == "" {
+		r.BlueGreen.keepDuration = config.GetDuration(config.BlueGreenKeepTime)
+		r.BlueGreen.KeepTime = r.BlueGreen.keepDuration.String()
+	} else {
+		keepDuration, err := time.ParseDuration(r.BlueGreen.KeepTime)
+		if err != nil || keepDuration < 0 {
+			return RolloutInitError{
+				message: fmt.Sprintf("Invalid blue/green keep time %s", r.BlueGreen.KeepTime),
+			}
+		}
+		r.BlueGreen.keepDuration = keepDuration
+	}
+
+	service, err := kube.GetClient(r.Env).Services().Get(r.DeploymentName, metav1.GetOptions{})
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+			return RolloutInitError{
+				message: fmt.Sprintf("Service %s not found, blue/green rollouts require a service", r.DeploymentName),
+			}
+		}
+		return err
+	}
+	r.BlueGreen.PreviousColor = service.Spec.Selector[colorLabel]
+	r.BlueGreen.Color = otherColor(r.BlueGreen.PreviousColor)
+
+	if r.BlueGreen.PreviousColor != "" {
+		r.FromDeployment = nil
+		r.FromRevision = ""
+		liveDeployment, err := getBlueGreenDeployment(r.Env, r.DeploymentName, r.BlueGreen.PreviousColor)
+		if err != nil {
+			return err
+		}
+		if liveDeployment != nil {
+			r.FromDeployment = liveDeployment
+			r.FromRevision = liveDeployment.ObjectMeta.Annotations["deployment.kubernetes.io/revision"]
+		}
+	}
+	return nil
+}
+
+// createBlueGreenDeployment creates or updates the deployment for the new color
+func (r *Rollout) createBlueGreenDeployment() (err error) {
+	endpoint := kube.GetClient(r.Env).Deployments()
+	deployment, err := r.renderDeployment()
+	if err != nil {
+		return
+	}
+
+	labels := map[string]string{
+		"app":      r.DeploymentName,
+		colorLabel: r.BlueGreen.Color,
+	}
+	deployment.ObjectMeta.Name = blueGreenDeploymentName(r.DeploymentName, r.BlueGreen.Color)
+	deployment.ObjectMeta.Labels = labels
+	deployment.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: labels,
+	}
+	deployment.Spec.Template.ObjectMeta.Labels = labels
+
+	// the original deployment is replaced by the deployment for the color it
+	// was labeled with by the first blue/green rollout
+	original, err := endpoint.Get(r.DeploymentName, metav1.GetOptions{})
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); !ok || statusError.Status().Code != http.StatusNotFound {
+			return
+		}
+		err = nil
+	} else if original.Spec.Template.ObjectMeta.Labels[colorLabel] == r.BlueGreen.Color {
+		propagationPolicy := metav1.DeletePropagationBackground
+		err = endpoint.Delete(r.DeploymentName, &metav1.DeleteOptions{
+			PropagationPolicy: &propagationPolicy,
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// create/update deployment
+	r.ToDeployment, err = endpoint.Update(deployment)
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+			r.ToDeployment, err = endpoint.Create(deployment)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	r.logMessage(fmt.Sprintf(
+		"Blue/green rollout to %s for tag %s and branch %s created by %s",
+		r.BlueGreen.Color, r.Tag, r.Branch, r.Username,
+	), log.InfoLevel)
+	return
+}
+
+// switchBlueGreen waits until the new color is fully available and switches
+// the service selector over to it
+func (r *Rollout) switchBlueGreen() error {
+	startTime := time.Now()
+	err := r.waitDeploymentAvailable(blueGreenDeploymentName(r.DeploymentName, r.BlueGreen.Color), nil)
+	if err != nil {
+		r.logMessage(fmt.Sprintf("Aborted blue/green rollout: %s", err), log.ErrorLevel)
+		r.finish(err)
+		return err
+	}
+	if r.BlueGreen.PreviousColor == "" && r.FromDeployment != nil {
+		err = r.labelOriginalDeployment()
+		if err != nil {
+			r.logMessage(fmt.Sprintf("Aborted blue/green rollout: failed labeling %s: %s", r.DeploymentName, err), log.ErrorLevel)
+			r.finish(err)
+			return err
+		}
+	}
+	_, err = switchServiceColor(r.Env, r.DeploymentName, r.BlueGreen.Color)
+	if err != nil {
+		r.logMessage(fmt.Sprintf("Failed switching service to %s: %s", r.BlueGreen.Color, err), log.ErrorLevel)
+		r.finish(err)
+		return err
+	}
+	elapsed := time.Now().Sub(startTime)
+	r.logMessage(fmt.Sprintf("Switched service to %s after %s", r.BlueGreen.Color, humanizeDuration(elapsed)), log.InfoLevel)
+	err = r.complete(nil)
+	if err != nil {
+		return err
+	}
+
+	if r.FromDeployment != nil {
+		scaleDown := &blueGreenScaleDown{
+			Deployment:         r.DeploymentName,
+			Color:              r.BlueGreen.Color,
+			PreviousDeployment: r.FromDeployment.ObjectMeta.Name,
+			ScaleDownAt:        time.Now().Add(r.BlueGreen.keepDuration),
+		}
+		if err := setBlueGreenScaleDown(r.Env, scaleDown); err != nil {
+			r.logMessage(fmt.Sprintf("Failed scheduling scale down of %s: %s", scaleDown.PreviousDeployment, err), log.ErrorLevel)
+		}
+	}
+	return nil
+}
+
+// labelOriginalDeployment labels the pods of the deployment that was live
+// before the first blue/green rollout with the other color, so that the
+// service can be switched back to it, and waits until they are available
+func (r *Rollout) labelOriginalDeployment() error {
+	color := otherColor(r.BlueGreen.Color)
+	endpoint := kube.GetClient(r.Env).Deployments()
+	deployment, err := endpoint.Get(r.DeploymentName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if deployment.ObjectMeta.Labels == nil {
+		deployment.ObjectMeta.Labels = map[string]string{}
+	}
+	deployment.ObjectMeta.Labels[colorLabel] = color
+	if deployment.Spec.Template.ObjectMeta.Labels == nil {
+		deployment.Spec.Template.ObjectMeta.Labels = map[string]string{}
+	}
+	deployment.Spec.Template.ObjectMeta.Labels[colorLabel] = color
+	if _, err := endpoint.Update(deployment); err != nil {
+		return err
+	}
+	if err := r.waitDeploymentAvailable(r.DeploymentName, nil); err != nil {
+		return err
+	}
+	r.BlueGreen.PreviousColor = color
+	r.logMessage(fmt.Sprintf("Labeled %s as %s", r.DeploymentName, color), log.InfoLevel)
+	return nil
+}
+
+// blueGreenScaleDown is a previous color that is scaled down at ScaleDownAt,
+// unless the service was switched away from Color in the meantime
+type blueGreenScaleDown struct {
+	Deployment         string    `json:"deployment"`
+	Color              string    `json:"color"`
+	PreviousDeployment string    `json:"previousDeployment"`
+	ScaleDownAt        time.Time `json:"scaleDownAt"`
+}
+
+// RunBlueGreenScaleDowns scales down previous colors once the keep time of the
+// blue/green rollouts that replaced them has passed, until the server exits.
+// Every replica runs it, and each scale down is claimed by removing it from
+// redis, so that only one replica runs it.
+func RunBlueGreenScaleDowns() {
+	ticker := time.NewTicker(blueGreenScaleDownInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, environment := range environments.Environments() {
+				if err := runBlueGreenScaleDowns(environment.Name); err != nil {
+					log.WithError(err).Errorf("failed running blue/green scale downs for %s", environment.Name)
+				}
+			}
+		case <-ExitingChan:
+			return
+		}
+	}
+}
+
+func runBlueGreenScaleDowns(env string) error {
+	values, err := redis.GetClient().HGetAllMap(blueGreenScaleDownsRedisKey(env)).Result()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for deploymentName, data := range values {
+		scaleDown := new(blueGreenScaleDown)
+		if err := json.Unmarshal([]byte(data), scaleDown); err != nil {
+			log.WithError(err).Warn("failed reading blue/green scale down")
+			continue
+		}
+		if scaleDown.ScaleDownAt.After(now) {
+			continue
+		}
+		claimed, err := redis.GetClient().HDel(blueGreenScaleDownsRedisKey(env), deploymentName).Result()
+		if err != nil {
+			return err
+		}
+		if claimed == 0 {
+			// another replica is scaling it down
+			continue
+		}
+		if err := scaleDownPreviousColor(env, scaleDown); err != nil {
+			message := fmt.Sprintf("Failed scaling down %s: %s", scaleDown.PreviousDeployment, err)
+			logMessage(
+				fmt.Sprintf("%s - %s - %s", env, deploymentName, message),
+				fmt.Sprintf("*%s* - *%s* - %s", env, deploymentName, message),
+				log.ErrorLevel,
+			)
+		}
+	}
+	return nil
+}
+
+// scaleDownPreviousColor scales the previously live deployment down, unless
+// the service was switched back to it
+func scaleDownPreviousColor(env string, scaleDown *blueGreenScaleDown) error {
+	service, err := kube.GetClient(env).Services().Get(scaleDown.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if service.Spec.Selector[colorLabel] != scaleDown.Color {
+		// the service was switched to another color in the meantime
+		return nil
+	}
+	_, err = kube.GetClient(env).Deployments().UpdateScale(scaleDown.PreviousDeployment, &extv1beta1.Scale{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      scaleDown.PreviousDeployment,
+			Namespace: kube.GetClient(env).Namespace(),
+		},
+		Spec: extv1beta1.ScaleSpec{
+			Replicas: 0,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Scaled down %s", scaleDown.PreviousDeployment)
+	logMessage(
+		fmt.Sprintf("%s - %s - %s", env, scaleDown.Deployment, message),
+		fmt.Sprintf("*%s* - *%s* - %s", env, scaleDown.Deployment, message),
+		log.InfoLevel,
+	)
+	return nil
+}
+
+func blueGreenScaleDownsRedisKey(env string) string {
+	return fmt.Sprintf("bluegreen:%s:scaledowns", env)
+}
+
+func setBlueGreenScaleDown(env string, scaleDown *blueGreenScaleDown) error {
+	data, err := json.Marshal(scaleDown)
+	if err != nil {
+		return err
+	}
+	return redis.GetClient().HSet(blueGreenScaleDownsRedisKey(env), scaleDown.Deployment, string(data)).Err()
+}
+
+// switchServiceColor points the deployment's service to the given color
+func switchServiceColor(env, deploymentName, color string) (*corev1.Service, error) {
+	endpoint := kube.GetClient(env).Services()
+	service, err := endpoint.Get(deploymentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// other selector labels of the service are kept
+	if service.Spec.Selector == nil {
+		service.Spec.Selector = map[string]string{}
+	}
+	service.Spec.Selector["app"] = deploymentName
+	service.Spec.Selector[colorLabel] = color
+	return endpoint.Update(service)
+}
+
+// deploymentSwitchHandler switches the service of a blue/green deployment back
+// to the other color, as long as it is still scaled up
+func deploymentSwitchHandler(c echo.Context, env, deploymentName string) error {
+	actionRequest := new(deploymentActionRequest)
+	// ignore errors, as the color is optional
+	json.NewDecoder(c.Request().Body).Decode(actionRequest)
+
+	service, err := kube.GetClient(env).Services().Get(deploymentName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	currentColor := service.Spec.Selector[colorLabel]
+	color := actionRequest.Color
+	if color == "" {
+		if currentColor == "" {
+			return server.ErrorResponse(c, errors.BadRequest("Service is not using blue/green deployments"))
+		}
+		color = otherColor(currentColor)
+	}
+	if color != colorBlue && color != colorGreen {
+		return server.ErrorResponse(c, errors.BadRequest(fmt.Sprintf("Invalid color %s", color)))
+	}
+	if color == currentColor {
+		return server.ErrorResponse(c, errors.Conflict(fmt.Sprintf("Service already points to %s", color)))
+	}
+
+	deployment, err := getBlueGreenDeployment(env, deploymentName, color)
+	if err != nil {
+		return err
+	}
+	if deployment == nil {
+		return server.ErrorResponse(c, errors.NotFound(fmt.Sprintf("No %s deployment found for %s", color, deploymentName)))
+	}
+	if deployment.Status.AvailableReplicas == 0 {
+		return server.ErrorResponse(c, errors.Conflict(fmt.Sprintf("Deployment %s has no available replicas", deployment.Name)))
+	}
+
+	resp, err := switchServiceColor(env, deploymentName, color)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Switched service to %s by %s", color, c.Get("user").(*session.User).Username)
+	logMessage(
+		fmt.Sprintf("%s - %s - %s", env, deploymentName, message),
+		fmt.Sprintf("*%s* - *%s* - %s", env, deploymentName, message),
+		log.WarnLevel,
+	)
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/viliproject/vili/config"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RolloutCanary configures a canary rollout, which runs the new tag in a
+// separate deployment before promoting it to the main deployment
+type RolloutCanary struct {
+	Replicas    int32  `json:"replicas"`
+	BakeTime    string `json:"bakeTime"`
+	MaxRestarts int32  `json:"maxRestarts"`
+
+	bakeDuration time.Duration
+}
+
+// initCanary validates the canary configuration and fills in the defaults
+func (r *Rollout) initCanary() error {
+	if r.Canary == nil {
+		r.Canary = &RolloutCanary{}
+	}
+	if r.Canary.Replicas <= 0 {
+		r.Canary.Replicas = 1
+	}
+	if r.Canary.MaxRestarts < 0 {
+		r.Canary.MaxRestarts = 0
+	}
+	if r.Canary.BakeTime == "" {
+		r.Canary.bakeDuration = config.GetDuration(config.CanaryBakeTime)
+		r.Canary.BakeTime = r.Canary.bakeDuration.String()
+		return nil
+	}
+	bakeDuration, err := time.ParseDuration(r.Canary.BakeTime)
+	if err != nil || bakeDuration < 0 {
+		return RolloutInitError{
+			message: fmt.Sprintf("Invalid canary bake time %s", r.Canary.BakeTime),
+		}
+	}
+	r.Canary.bakeDuration = bakeDuration
+	return nil
+}
+
+func (r *Rollout) canaryName() string {
+	return r.DeploymentName + "-canary"
+}
+
+// createCanaryDeployment creates a deployment running the new tag next to the
+// main deployment, which receives traffic through the same service
+func (r *Rollout) createCanaryDeployment() (err error) {
+	endpoint := kube.GetClient(r.Env).Deployments()
+	deployment, err := r.renderDeployment()
+	if err != nil {
+		return
+	}
+
+	labels := map[string]string{
+		"app":   r.DeploymentName,
+		"track": "canary",
+	}
+	replicas := r.Canary.Replicas
+	deployment.ObjectMeta.Name = r.canaryName()
+	deployment.ObjectMeta.Labels = labels
+	deployment.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: labels,
+	}
+	deployment.Spec.Template.ObjectMeta.Labels = labels
+	deployment.Spec.Replicas = &replicas
+
+	// create/update deployment
+	_, err = endpoint.Update(deployment)
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+			_, err = endpoint.Create(deployment)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	r.logMessage(fmt.Sprintf(
+		"Canary with %d replicas for tag %s and branch %s created by %s",
+		replicas, r.Tag, r.Branch, r.Username,
+	), log.InfoLevel)
+	return
+}
+
+// promoteCanary waits for the canary to become available and bakes it. If the
+// canary is healthy the main deployment is rolled out, otherwise the rollout is
+// aborted. The canary deployment is deleted in both cases.
+func (r *Rollout) promoteCanary() error {
+	defer r.deleteCanary()
+
+	err := r.bakeCanary()
+	if err != nil {
+		r.logMessage(fmt.Sprintf("Aborted canary: %s", err), log.ErrorLevel)
+		r.finish(err)
+		return err
+	}
+
+	r.logMessage(fmt.Sprintf("Promoting canary after baking for %s", r.Canary.BakeTime), log.InfoLevel)
+	err = r.createNewDeployment()
+	if err != nil {
+		r.finish(err)
+		return err
+	}
+	return r.watch()
+}
+
+// bakeCanary waits until all canary replicas are available, then checks the
+// canary pods' readiness and restart counts until the bake time has passed
+func (r *Rollout) bakeCanary() error {
+	startTime := time.Now()
+	err := r.waitDeploymentAvailable(r.canaryName(), func(deployment *extv1beta1.Deployment) error {
+		return r.checkCanaryPods(deployment, false)
+	})
+	if err != nil {
+		return err
+	}
+	elapsed := time.Now().Sub(startTime)
+	r.logMessage(fmt.Sprintf("Canary available after %s, baking for %s", humanizeDuration(elapsed), r.Canary.BakeTime), log.InfoLevel)
+
+	endpoint := kube.GetClient(r.Env).Deployments()
+	ticker := time.NewTicker(deploymentPollInterval)
+	defer ticker.Stop()
+	bakeDone := time.After(r.Canary.bakeDuration)
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.checkAborted(); err != nil {
+				return err
+			}
+			deployment, err := endpoint.Get(r.canaryName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if err := r.checkCanaryPods(deployment, true); err != nil {
+				return err
+			}
+		case <-bakeDone:
+			return nil
+		case <-ExitingChan:
+			return errViliExiting
+		}
+	}
+}
+
+// checkCanaryPods returns an error if any canary pod restarted more than the
+// allowed number of times, or if requireReady is set and a pod is not ready
+func (r *Rollout) checkCanaryPods(deployment *extv1beta1.Deployment, requireReady bool) error {
+	pods, err := kube.GetClient(r.Env).Pods().List(getListOptionsForDeployment(deployment))
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.RestartCount > r.Canary.MaxRestarts {
+				return fmt.Errorf("container %s in pod %s restarted %d times", status.Name, pod.Name, status.RestartCount)
+			}
+			if requireReady && !status.Ready {
+				return fmt.Errorf("container %s in pod %s is not ready", status.Name, pod.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Rollout) deleteCanary() {
+	propagationPolicy := metav1.DeletePropagationForeground
+	err := kube.GetClient(r.Env).Deployments().Delete(r.canaryName(), &metav1.DeleteOptions{
+		PropagationPolicy: &propagationPolicy,
+	})
+	if err != nil {
+		r.logMessage(fmt.Sprintf("Failed deleting canary: %s", err), log.ErrorLevel)
+		return
+	}
+	r.logMessage("Deleted canary", log.InfoLevel)
+}
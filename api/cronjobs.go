@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/repository"
+	"github.com/viliproject/vili/server"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/templates"
+	"github.com/viliproject/vili/util"
+	"github.com/labstack/echo"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func cronJobsGetHandler(c echo.Context) error {
+	env := c.Param("env")
+
+	endpoint := kube.GetClient(env).CronJobs()
+	query := getListOptionsFromRequest(c)
+
+	if c.Request().URL.Query().Get("watch") != "" {
+		return apiWatchWebsocket(c, query, endpoint.Watch)
+	}
+
+	// otherwise, return the cron jobs list
+	resp, err := endpoint.List(query)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func cronJobRepositoryGetHandler(c echo.Context) error {
+	env := c.Param("env")
+	cronJob := c.Param("cronjob")
+
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+
+	resp := new(jobRepositoryResponse)
+	images, err := repository.GetDockerRepository(cronJob, environment.RepositoryBranches)
+	if err != nil {
+		return err
+	}
+	resp.Images = images
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func cronJobSpecGetHandler(c echo.Context) error {
+	env := c.Param("env")
+	cronJob := c.Param("cronjob")
+
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+
+	resp := new(jobSpecResponse)
+	body, err := templates.CronJob(environment.Name, environment.Branch, cronJob)
+	if err != nil {
+		return err
+	}
+	resp.Spec = string(body)
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+const (
+	cronJobActionDeploy  = "deploy"
+	cronJobActionSuspend = "suspend"
+	cronJobActionResume  = "resume"
+	cronJobActionTrigger = "trigger"
+)
+
+// cronJobDeployRequest is the request to deploy a cron job
+type cronJobDeployRequest struct {
+	Branch string `json:"branch"`
+	Tag    string `json:"tag"`
+}
+
+func cronJobActionHandler(c echo.Context) error {
+	env := c.Param("env")
+	cronJobName := c.Param("cronjob")
+	action := c.Param("action")
+	username := c.Get("user").(*session.User).Username
+
+	if action == cronJobActionDeploy {
+		deployRequest := new(cronJobDeployRequest)
+		if err := json.NewDecoder(c.Request().Body).Decode(deployRequest); err != nil {
+			return err
+		}
+		if deployRequest.Branch == "" {
+			return server.ErrorResponse(c, errors.BadRequest("Request missing branch"))
+		}
+		if deployRequest.Tag == "" {
+			return server.ErrorResponse(c, errors.BadRequest("Request missing tag"))
+		}
+		cronJob, err := deployCronJob(env, cronJobName, deployRequest.Branch, deployRequest.Tag, username)
+		if err != nil {
+			if e, ok := err.(JobRunInitError); ok {
+				return server.ErrorResponse(c, errors.BadRequest(e.Error()))
+			}
+			return err
+		}
+		return c.JSON(http.StatusOK, cronJob)
+	}
+
+	endpoint := kube.GetClient(env).CronJobs()
+	cronJob, err := endpoint.Get(cronJobName, metav1.GetOptions{})
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+			return server.ErrorResponse(c, errors.NotFound(fmt.Sprintf("Cron job %s not found", cronJobName)))
+		}
+		return err
+	}
+
+	var resp interface{}
+	switch action {
+	case cronJobActionSuspend, cronJobActionResume:
+		suspend := action == cronJobActionSuspend
+		cronJob.Spec.Suspend = &suspend
+		resp, err = endpoint.Update(cronJob)
+	case cronJobActionTrigger:
+		resp, err = triggerCronJob(env, cronJob)
+	default:
+		return server.ErrorResponse(c, errors.NotFound(fmt.Sprintf("Action %s not found", action)))
+	}
+	if err != nil {
+		return err
+	}
+	description := fmt.Sprintf("%sed by %s", action, username)
+	if action == cronJobActionResume {
+		description = fmt.Sprintf("resumed by %s", username)
+	}
+	logMessage(
+		fmt.Sprintf("%s - %s - %s", env, cronJobName, description),
+		fmt.Sprintf("*%s* - *%s* - %s", env, cronJobName, description),
+		log.InfoLevel,
+	)
+	return c.JSON(http.StatusOK, resp)
+}
+
+// deployCronJob creates or updates the cron job from its template in the
+// branch, with the images set to the tag. A suspended cron job stays
+// suspended.
+func deployCronJob(env, name, branch, tag, username string) (*batchv1beta1.CronJob, error) {
+	digest, err := repository.GetDockerTag(name, tag)
+	if err != nil {
+		return nil, err
+	}
+	if digest == "" {
+		return nil, JobRunInitError{
+			message: fmt.Sprintf("Tag %s not found for cron job %s", tag, name),
+		}
+	}
+
+	cronJobTemplate, err := templates.CronJob(env, branch, name)
+	if err != nil {
+		return nil, err
+	}
+	if cronJobTemplate == "" {
+		return nil, JobRunInitError{
+			message: fmt.Sprintf("Cron job %s has no template in %s", name, env),
+		}
+	}
+	cronJob := new(batchv1beta1.CronJob)
+	if err := cronJobTemplate.Parse(cronJob); err != nil {
+		return nil, err
+	}
+
+	podSpec := &cronJob.Spec.JobTemplate.Spec.Template.Spec
+	if err := setContainerImages(podSpec, cronJob.ObjectMeta.Annotations, name, tag, nil); err != nil {
+		if e, ok := err.(containerImageError); ok {
+			err = JobRunInitError{message: e.Error()}
+		}
+		return nil, err
+	}
+
+	cronJob.ObjectMeta.Name = name
+	labels := map[string]string{
+		"cronjob": name,
+	}
+	cronJob.ObjectMeta.Labels = labels
+	cronJob.Spec.JobTemplate.ObjectMeta.Labels = labels
+	cronJob.Spec.JobTemplate.Spec.Template.ObjectMeta.Labels = labels
+	if cronJob.ObjectMeta.Annotations == nil {
+		cronJob.ObjectMeta.Annotations = map[string]string{}
+	}
+	cronJob.ObjectMeta.Annotations["vili/branch"] = branch
+	cronJob.ObjectMeta.Annotations["vili/deployedBy"] = username
+
+	endpoint := kube.GetClient(env).CronJobs()
+	existing, err := endpoint.Get(name, metav1.GetOptions{})
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); !ok || statusError.Status().Code != http.StatusNotFound {
+			return nil, err
+		}
+		cronJob, err = endpoint.Create(cronJob)
+	} else {
+		cronJob.ObjectMeta.ResourceVersion = existing.ObjectMeta.ResourceVersion
+		cronJob.Spec.Suspend = existing.Spec.Suspend
+		cronJob, err = endpoint.Update(cronJob)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logMessage(
+		fmt.Sprintf("%s - %s - deployed tag %s from branch %s by %s", env, name, tag, branch, username),
+		fmt.Sprintf("*%s* - *%s* - deployed tag %s from branch %s by %s", env, name, tag, branch, username),
+		log.InfoLevel,
+	)
+	return cronJob, nil
+}
+
+// triggerCronJob creates a job from the job template of the cron job, the way
+// the cron job controller does on schedule
+func triggerCronJob(env string, cronJob *batchv1beta1.CronJob) (*batchv1.Job, error) {
+	annotations := map[string]string{
+		"cronjob.kubernetes.io/instantiate": "manual",
+	}
+	for key, value := range cronJob.Spec.JobTemplate.ObjectMeta.Annotations {
+		annotations[key] = value
+	}
+	isController := true
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-manual-%s", cronJob.ObjectMeta.Name, util.RandLowercaseString(6)),
+			Labels:      cronJob.Spec.JobTemplate.ObjectMeta.Labels,
+			Annotations: annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "batch/v1beta1",
+					Kind:       "CronJob",
+					Name:       cronJob.ObjectMeta.Name,
+					UID:        cronJob.ObjectMeta.UID,
+					Controller: &isController,
+				},
+			},
+		},
+		Spec: cronJob.Spec.JobTemplate.Spec,
+	}
+	return kube.GetClient(env).Jobs().Create(job)
+}
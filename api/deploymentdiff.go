@@ -0,0 +1,202 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// Deployment change types
+const (
+	deploymentChangeAdded   = "added"
+	deploymentChangeRemoved = "removed"
+	deploymentChangeChanged = "changed"
+)
+
+// DeploymentChange is a single difference between the live deployment and the
+// deployment that a rollout would create
+type DeploymentChange struct {
+	Path string      `json:"path"`
+	Type string      `json:"type"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// diffDeployments returns the changes to the replicas, images, env vars,
+// resources, probes and volumes between the from and to deployments. A nil
+// from deployment is treated as an empty one.
+func diffDeployments(from, to *extv1beta1.Deployment) []*DeploymentChange {
+	if from == nil {
+		from = &extv1beta1.Deployment{}
+	}
+	d := &deploymentDiff{changes: []*DeploymentChange{}}
+
+	var fromReplicas, toReplicas interface{}
+	if from.Spec.Replicas != nil {
+		fromReplicas = *from.Spec.Replicas
+	}
+	if to.Spec.Replicas != nil {
+		toReplicas = *to.Spec.Replicas
+	}
+	d.compare("replicas", fromReplicas, toReplicas)
+
+	d.containers("initContainers", from.Spec.Template.Spec.InitContainers, to.Spec.Template.Spec.InitContainers)
+	d.containers("containers", from.Spec.Template.Spec.Containers, to.Spec.Template.Spec.Containers)
+
+	fromVolumes := map[string]interface{}{}
+	for _, volume := range from.Spec.Template.Spec.Volumes {
+		fromVolumes[volume.Name] = volume
+	}
+	toVolumes := map[string]interface{}{}
+	for _, volume := range to.Spec.Template.Spec.Volumes {
+		toVolumes[volume.Name] = normalizeVolume(volume)
+	}
+	d.compareMaps("volumes", fromVolumes, toVolumes)
+	return d.changes
+}
+
+type deploymentDiff struct {
+	changes []*DeploymentChange
+}
+
+// compare records a change if the values differ. Nil values mean that the
+// field is not set.
+func (d *deploymentDiff) compare(path string, from, to interface{}) {
+	switch {
+	case from == nil && to == nil:
+	case from == nil:
+		d.changes = append(d.changes, &DeploymentChange{Path: path, Type: deploymentChangeAdded, To: to})
+	case to == nil:
+		d.changes = append(d.changes, &DeploymentChange{Path: path, Type: deploymentChangeRemoved, From: from})
+	case !equality.Semantic.DeepEqual(from, to):
+		d.changes = append(d.changes, &DeploymentChange{Path: path, Type: deploymentChangeChanged, From: from, To: to})
+	}
+}
+
+// compareMaps compares the values of both maps by key, in sorted key order
+func (d *deploymentDiff) compareMaps(path string, from, to map[string]interface{}) {
+	keys := []string{}
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		d.compare(path+"."+key, from[key], to[key])
+	}
+}
+
+func (d *deploymentDiff) containers(path string, from, to []corev1.Container) {
+	fromContainers := map[string]corev1.Container{}
+	for _, container := range from {
+		fromContainers[container.Name] = container
+	}
+	toContainers := map[string]corev1.Container{}
+	for _, container := range to {
+		toContainers[container.Name] = container
+	}
+
+	for _, container := range from {
+		if _, ok := toContainers[container.Name]; !ok {
+			d.compare(fmt.Sprintf("%s[%s]", path, container.Name), container.Image, nil)
+		}
+	}
+	for _, toContainer := range to {
+		containerPath := fmt.Sprintf("%s[%s]", path, toContainer.Name)
+		fromContainer, ok := fromContainers[toContainer.Name]
+		if !ok {
+			d.compare(containerPath, nil, toContainer.Image)
+			continue
+		}
+
+		d.compare(containerPath+".image", fromContainer.Image, toContainer.Image)
+
+		fromEnv := map[string]interface{}{}
+		for _, envVar := range fromContainer.Env {
+			fromEnv[envVar.Name] = envVarValue(envVar)
+		}
+		toEnv := map[string]interface{}{}
+		for _, envVar := range toContainer.Env {
+			toEnv[envVar.Name] = envVarValue(envVar)
+		}
+		d.compareMaps(containerPath+".env", fromEnv, toEnv)
+
+		d.compareMaps(containerPath+".resources.requests",
+			resourceListValues(fromContainer.Resources.Requests), resourceListValues(toContainer.Resources.Requests))
+		d.compareMaps(containerPath+".resources.limits",
+			resourceListValues(fromContainer.Resources.Limits), resourceListValues(toContainer.Resources.Limits))
+
+		d.compare(containerPath+".livenessProbe",
+			probeValue(fromContainer.LivenessProbe), probeValue(normalizeProbe(toContainer.LivenessProbe)))
+		d.compare(containerPath+".readinessProbe",
+			probeValue(fromContainer.ReadinessProbe), probeValue(normalizeProbe(toContainer.ReadinessProbe)))
+	}
+}
+
+func envVarValue(envVar corev1.EnvVar) interface{} {
+	if envVar.ValueFrom != nil {
+		return envVar.ValueFrom
+	}
+	return envVar.Value
+}
+
+func resourceListValues(resources corev1.ResourceList) map[string]interface{} {
+	values := map[string]interface{}{}
+	for name, quantity := range resources {
+		values[string(name)] = quantity.String()
+	}
+	return values
+}
+
+func probeValue(probe *corev1.Probe) interface{} {
+	if probe == nil {
+		return nil
+	}
+	return probe
+}
+
+// normalizeProbe fills in the defaults that kubernetes sets on probes, so that
+// they do not show up as changes against the live deployment
+func normalizeProbe(probe *corev1.Probe) *corev1.Probe {
+	if probe == nil {
+		return nil
+	}
+	probe = probe.DeepCopy()
+	if probe.TimeoutSeconds == 0 {
+		probe.TimeoutSeconds = 1
+	}
+	if probe.PeriodSeconds == 0 {
+		probe.PeriodSeconds = 10
+	}
+	if probe.SuccessThreshold == 0 {
+		probe.SuccessThreshold = 1
+	}
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = 3
+	}
+	if probe.HTTPGet != nil && probe.HTTPGet.Scheme == "" {
+		probe.HTTPGet.Scheme = corev1.URISchemeHTTP
+	}
+	return probe
+}
+
+// normalizeVolume fills in the default file mode that kubernetes sets on
+// config map and secret volumes
+func normalizeVolume(volume corev1.Volume) corev1.Volume {
+	volume = *volume.DeepCopy()
+	defaultMode := corev1.ConfigMapVolumeSourceDefaultMode
+	if volume.ConfigMap != nil && volume.ConfigMap.DefaultMode == nil {
+		volume.ConfigMap.DefaultMode = &defaultMode
+	}
+	if volume.Secret != nil && volume.Secret.DefaultMode == nil {
+		volume.Secret.DefaultMode = &defaultMode
+	}
+	return volume
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func testDeployment(replicas int32, containers ...corev1.Container) *extv1beta1.Deployment {
+	deployment := &extv1beta1.Deployment{}
+	deployment.Spec.Replicas = &replicas
+	deployment.Spec.Template.Spec.Containers = containers
+	return deployment
+}
+
+func TestDiffDeployments(t *testing.T) {
+	app := corev1.Container{
+		Name:  "app",
+		Image: "app:1",
+		Env: []corev1.EnvVar{
+			{Name: "MODE", Value: "fast"},
+			{Name: "OLD", Value: "1"},
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+		},
+	}
+	newApp := *app.DeepCopy()
+	newApp.Image = "app:2"
+	newApp.Env = []corev1.EnvVar{
+		{Name: "MODE", Value: "slow"},
+		{Name: "NEW", Value: "2"},
+	}
+	newApp.Resources.Requests[corev1.ResourceCPU] = resource.MustParse("200m")
+	probed := *app.DeepCopy()
+	probed.ReadinessProbe = &corev1.Probe{
+		Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: "/health"}},
+	}
+	liveProbed := *app.DeepCopy()
+	liveProbed.ReadinessProbe = normalizeProbe(probed.ReadinessProbe)
+	sidecar := corev1.Container{Name: "sidecar", Image: "sidecar:1"}
+
+	testCases := []struct {
+		name    string
+		from    *extv1beta1.Deployment
+		to      *extv1beta1.Deployment
+		changes []*DeploymentChange
+	}{
+		{
+			name:    "unchanged",
+			from:    testDeployment(2, app),
+			to:      testDeployment(2, app),
+			changes: []*DeploymentChange{},
+		},
+		{
+			name: "new deployment",
+			from: nil,
+			to:   testDeployment(2, app),
+			changes: []*DeploymentChange{
+				{Path: "replicas", Type: deploymentChangeAdded, To: int32(2)},
+				{Path: "containers[app]", Type: deploymentChangeAdded, To: "app:1"},
+			},
+		},
+		{
+			name: "replicas",
+			from: testDeployment(2, app),
+			to:   testDeployment(3, app),
+			changes: []*DeploymentChange{
+				{Path: "replicas", Type: deploymentChangeChanged, From: int32(2), To: int32(3)},
+			},
+		},
+		{
+			name: "image, env and resources",
+			from: testDeployment(2, app),
+			to:   testDeployment(2, newApp),
+			changes: []*DeploymentChange{
+				{Path: "containers[app].image", Type: deploymentChangeChanged, From: "app:1", To: "app:2"},
+				{Path: "containers[app].env.MODE", Type: deploymentChangeChanged, From: "fast", To: "slow"},
+				{Path: "containers[app].env.NEW", Type: deploymentChangeAdded, To: "2"},
+				{Path: "containers[app].env.OLD", Type: deploymentChangeRemoved, From: "1"},
+				{Path: "containers[app].resources.requests.cpu", Type: deploymentChangeChanged, From: "100m", To: "200m"},
+			},
+		},
+		{
+			name: "containers",
+			from: testDeployment(2, app, sidecar),
+			to:   testDeployment(2, app),
+			changes: []*DeploymentChange{
+				{Path: "containers[sidecar]", Type: deploymentChangeRemoved, From: "sidecar:1"},
+			},
+		},
+		{
+			name:    "probe defaults",
+			from:    testDeployment(2, liveProbed),
+			to:      testDeployment(2, probed),
+			changes: []*DeploymentChange{},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.changes, diffDeployments(testCase.from, testCase.to))
+		})
+	}
+}
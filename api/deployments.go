@@ -154,25 +154,7 @@ func deploymentServiceCreateHandler(c echo.Context) error {
 		return err
 	}
 
-	service := &corev1.Service{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name: deploymentName,
-		},
-		Spec: corev1.ServiceSpec{
-			Ports: []corev1.ServicePort{
-				corev1.ServicePort{
-					Protocol: "TCP",
-					Port:     deploymentPort,
-				},
-			},
-			Selector: map[string]string{
-				"app": deploymentName,
-			},
-		},
-	}
+	service := newDeploymentService(deploymentName, deploymentPort)
 
 	resp, err := endpoint.Create(service)
 	if err != nil {
@@ -184,6 +166,7 @@ func deploymentServiceCreateHandler(c echo.Context) error {
 type deploymentActionRequest struct {
 	Replicas   *int32 `json:"replicas"`
 	ToRevision int64  `json:"toRevision"`
+	Color      string `json:"color"`
 }
 
 const (
@@ -191,6 +174,7 @@ const (
 	deploymentActionPause    = "pause"
 	deploymentActionRollback = "rollback"
 	deploymentActionScale    = "scale"
+	deploymentActionSwitch   = "switch"
 )
 
 func deploymentActionHandler(c echo.Context) (err error) {
@@ -198,6 +182,11 @@ func deploymentActionHandler(c echo.Context) (err error) {
 	deploymentName := c.Param("deployment")
 	action := c.Param("action")
 
+	if action == deploymentActionSwitch {
+		// blue/green deployments are switched through their service
+		return deploymentSwitchHandler(c, env, deploymentName)
+	}
+
 	kubeClient := kube.GetClient(env)
 	endpoint := kubeClient.Deployments()
 
@@ -220,12 +209,7 @@ func deploymentActionHandler(c echo.Context) (err error) {
 		deployment.Spec.Paused = true
 		resp, err = endpoint.Update(deployment)
 	case deploymentActionRollback:
-		err = endpoint.Rollback(&extv1beta1.DeploymentRollback{
-			Name: deploymentName,
-			RollbackTo: extv1beta1.RollbackConfig{
-				Revision: actionRequest.ToRevision,
-			},
-		})
+		err = rollbackDeployment(env, deploymentName, actionRequest.ToRevision)
 	case deploymentActionScale:
 		if actionRequest.Replicas == nil {
 			return server.ErrorResponse(c, errors.BadRequest("Replicas missing from scale request"))
@@ -249,6 +233,16 @@ func deploymentActionHandler(c echo.Context) (err error) {
 	return c.JSON(http.StatusOK, resp)
 }
 
+// rollbackDeployment rolls the deployment back to the given revision
+func rollbackDeployment(env, deploymentName string, toRevision int64) error {
+	return kube.GetClient(env).Deployments().Rollback(&extv1beta1.DeploymentRollback{
+		Name: deploymentName,
+		RollbackTo: extv1beta1.RollbackConfig{
+			Revision: toRevision,
+		},
+	})
+}
+
 func getRolloutHistoryForDeployment(env string, deployment *extv1beta1.Deployment) ([]*extv1beta1.ReplicaSet, error) {
 	var selector []string
 	for k, v := range deployment.Spec.Selector.MatchLabels {
@@ -290,3 +284,27 @@ func (s byRevision) Less(i, j int) bool {
 	rj, _ := strconv.Atoi(s[j].ObjectMeta.Annotations["deployment.kubernetes.io/revision"])
 	return ri > rj
 }
+
+// newDeploymentService returns a service that exposes the given port of the
+// pods of the deployment
+func newDeploymentService(deploymentName string, port int32) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: deploymentName,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				corev1.ServicePort{
+					Protocol: "TCP",
+					Port:     port,
+				},
+			},
+			Selector: map[string]string{
+				"app": deploymentName,
+			},
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/viliproject/vili/repository"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerRepositoriesAnnotation maps containers to the repositories their
+// images are built from, e.g. "nginx=app-nginx,migrate=app-migrations". The
+// first container is mapped to the deployment or job repository by default.
+const containerRepositoriesAnnotation = "vili/containerRepositories"
+
+// containerImageError is returned for invalid container tags in a request
+type containerImageError struct {
+	message string
+}
+
+func (e containerImageError) Error() string {
+	return e.message
+}
+
+// parseContainerRepositories parses the container repositories annotation
+func parseContainerRepositories(annotations map[string]string) (map[string]string, error) {
+	repositories := map[string]string{}
+	value := strings.TrimSpace(annotations[containerRepositoriesAnnotation])
+	if value == "" {
+		return repositories, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %s annotation entry %q", containerRepositoriesAnnotation, entry)
+		}
+		repositories[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return repositories, nil
+}
+
+// setContainerImages sets the image of every container and init container that
+// is mapped to a repository. Containers use the tag from containerTags if
+// set, otherwise defaultTag. The tag of every repository other than the
+// default one is checked, since the default repository is validated by the
+// caller.
+func setContainerImages(spec *corev1.PodSpec, annotations map[string]string, defaultRepository, defaultTag string, containerTags map[string]string) error {
+	if len(spec.Containers) == 0 {
+		return fmt.Errorf("no containers in pod spec")
+	}
+	repositories, err := parseContainerRepositories(annotations)
+	if err != nil {
+		return err
+	}
+	if _, ok := repositories[spec.Containers[0].Name]; !ok {
+		repositories[spec.Containers[0].Name] = defaultRepository
+	}
+
+	containers := map[string]*corev1.Container{}
+	for i := range spec.InitContainers {
+		containers[spec.InitContainers[i].Name] = &spec.InitContainers[i]
+	}
+	for i := range spec.Containers {
+		containers[spec.Containers[i].Name] = &spec.Containers[i]
+	}
+	for name := range containerTags {
+		if _, ok := repositories[name]; !ok {
+			return containerImageError{
+				message: fmt.Sprintf("Container %s is not mapped to a repository", name),
+			}
+		}
+	}
+
+	for name, repositoryName := range repositories {
+		container, ok := containers[name]
+		if !ok {
+			return fmt.Errorf("container %s in %s annotation not found", name, containerRepositoriesAnnotation)
+		}
+		tag := defaultTag
+		if containerTag, ok := containerTags[name]; ok && containerTag != "" {
+			tag = containerTag
+		}
+		if repositoryName != defaultRepository || tag != defaultTag {
+			digest, err := repository.GetDockerTag(repositoryName, tag)
+			if err != nil {
+				return err
+			}
+			if digest == "" {
+				return containerImageError{
+					message: fmt.Sprintf("Tag %s not found for container %s", tag, name),
+				}
+			}
+		}
+		imageName, err := repository.DockerFullName(repositoryName, tag)
+		if err != nil {
+			return err
+		}
+		container.Image = imageName
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/server"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+	batchv1 "k8s.io/api/batch/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	jobRunActionCancel = "cancel"
+	jobRunActionRetry  = "retry"
+
+	// jobConcurrencyPolicyAnnotation is the annotation in which a job
+	// template declares its concurrency policy
+	jobConcurrencyPolicyAnnotation = "vili/concurrencyPolicy"
+	// jobRunCancelledByAnnotation is set on a job before it is deleted to
+	// cancel it, so that the replica watching it can record who cancelled it
+	jobRunCancelledByAnnotation = "vili/cancelledBy"
+
+	// jobRunsLockTTL is how long the concurrency policy of a job stays
+	// locked if the replica that locked it does not unlock it
+	jobRunsLockTTL = time.Minute
+)
+
+func jobRunActionHandler(c echo.Context) error {
+	env := c.Param("env")
+	jobName := c.Param("job")
+	id := strings.TrimPrefix(c.Param("run"), jobName+"-")
+	action := c.Param("action")
+	username := c.Get("user").(*session.User).Username
+
+	run, err := getJobRunValue(env, jobName, id)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		return server.ErrorResponse(c, errors.NotFound("Job run not found"))
+	}
+
+	switch action {
+	case jobRunActionCancel:
+		if err := cancelJobRun(run, username); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	case jobRunActionRetry:
+		retry := &JobRun{
+			Env:        run.Env,
+			JobName:    run.JobName,
+			Branch:     run.Branch,
+			Tag:        run.Tag,
+			Username:   username,
+			Parameters: run.Parameters,
+			RetryOf:    run.ID,
+		}
+		err := retry.Run(c.Request().URL.Query().Get("async") != "")
+		if err != nil {
+			if e, ok := err.(JobRunInitError); ok {
+				return server.ErrorResponse(c, errors.BadRequest(e.Error()))
+			}
+			return err
+		}
+		return c.JSON(http.StatusOK, retry)
+	default:
+		return server.ErrorResponse(c, errors.NotFound(fmt.Sprintf("Action %s not found", action)))
+	}
+}
+
+// cancelJobRun deletes the job of the run and its pods, and records the run as
+// cancelled. The logs of the run are saved first, as the pods may be gone by
+// the time the replica watching the run sees that it was deleted, and no
+// replica may be watching it at all.
+func cancelJobRun(run *JobRun, username string) error {
+	endpoint := kube.GetClient(run.Env).Jobs()
+	job, err := endpoint.Get(run.RunName, metav1.GetOptions{})
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+			return errors.Conflict("Job run is not running")
+		}
+		return err
+	}
+	if !isJobActive(job) {
+		return errors.Conflict("Job run is not running")
+	}
+
+	pod, err := run.getLatestPod()
+	if err != nil {
+		log.WithError(err).Warn("failed getting job run pod")
+	}
+	if err := run.saveLogs(pod); err != nil {
+		log.WithError(err).Warn("failed saving job run logs")
+	}
+
+	if job.ObjectMeta.Annotations == nil {
+		job.ObjectMeta.Annotations = map[string]string{}
+	}
+	job.ObjectMeta.Annotations[jobRunCancelledByAnnotation] = username
+	if _, err := endpoint.Update(job); err != nil {
+		return err
+	}
+	propagationPolicy := metav1.DeletePropagationBackground
+	err = endpoint.Delete(run.RunName, &metav1.DeleteOptions{
+		PropagationPolicy: &propagationPolicy,
+	})
+	if err != nil {
+		return err
+	}
+
+	endedAt := time.Now()
+	run.EndedAt = &endedAt
+	run.Status = types.JobRunStatusCancelled
+	run.CancelledBy = username
+	run.ExitReason = "Cancelled by " + username
+	return setJobRunValue(run)
+}
+
+// applyConcurrencyPolicy checks the concurrency policy of the job against the
+// runs of the job that are still active. With the forbid policy it returns a
+// conflict error if there are any, and with the replace policy it cancels
+// them. With either policy the job is locked, so that no other run of it is
+// started until the caller has created the job and calls unlockJobRuns.
+func (r *JobRun) applyConcurrencyPolicy(job *batchv1.Job) error {
+	policy := types.JobConcurrencyPolicy(job.ObjectMeta.Annotations[jobConcurrencyPolicyAnnotation])
+	switch policy {
+	case "", types.JobConcurrencyPolicyAllow:
+		return nil
+	case types.JobConcurrencyPolicyForbid, types.JobConcurrencyPolicyReplace:
+	default:
+		return JobRunInitError{
+			message: fmt.Sprintf("Invalid concurrency policy %s, expected one of allow, forbid or replace", policy),
+		}
+	}
+
+	locked, err := redis.GetClient().SetNX(jobRunsLockRedisKey(r.Env, r.JobName), r.ID, jobRunsLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errors.Conflict(fmt.Sprintf("Job %s is being started by another run", r.JobName))
+	}
+
+	jobs, err := kube.GetClient(r.Env).Jobs().List(metav1.ListOptions{
+		LabelSelector: "job=" + r.JobName,
+	})
+	if err != nil {
+		return err
+	}
+	activeJobs := []string{}
+	for _, activeJob := range jobs.Items {
+		if isJobActive(&activeJob) {
+			activeJobs = append(activeJobs, activeJob.ObjectMeta.Name)
+		}
+	}
+	if len(activeJobs) == 0 {
+		return nil
+	}
+	if policy == types.JobConcurrencyPolicyForbid {
+		return errors.Conflict(fmt.Sprintf("Job %s is already running in %s", r.JobName, strings.Join(activeJobs, ", ")))
+	}
+
+	for _, activeJob := range activeJobs {
+		run, err := getJobRunValue(r.Env, r.JobName, strings.TrimPrefix(activeJob, r.JobName+"-"))
+		if err != nil {
+			return err
+		}
+		if run == nil {
+			// jobs that were not started by vili are not replaced
+			return errors.Conflict(fmt.Sprintf("Job %s is already running in %s", r.JobName, activeJob))
+		}
+		if err := cancelJobRun(run, r.Username); err != nil {
+			return err
+		}
+		logMessage(
+			fmt.Sprintf("%s - %s - run %s replaced by a new run from %s", r.Env, r.JobName, run.ID, r.Username),
+			fmt.Sprintf("*%s* - *%s* - run %s replaced by a new run from %s", r.Env, r.JobName, run.ID, r.Username),
+			log.InfoLevel,
+		)
+	}
+	return nil
+}
+
+// unlockJobRuns removes the lock taken by applyConcurrencyPolicy, if the run
+// holds it
+func (r *JobRun) unlockJobRuns() error {
+	key := jobRunsLockRedisKey(r.Env, r.JobName)
+	owner, err := redis.GetClient().Get(key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner != r.ID {
+		return nil
+	}
+	return redis.GetClient().Del(key).Err()
+}
+
+func jobRunsLockRedisKey(env, jobName string) string {
+	return jobRunsRedisKey(env, jobName) + ":lock"
+}
+
+// isJobActive returns whether the job has neither completed, failed nor been
+// deleted
+func isJobActive(job *batchv1.Job) bool {
+	if job.ObjectMeta.DeletionTimestamp != nil {
+		return false
+	}
+	for _, condition := range job.Status.Conditions {
+		switch condition.Type {
+		case batchv1.JobComplete, batchv1.JobFailed:
+			return false
+		}
+	}
+	return true
+}
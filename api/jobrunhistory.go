@@ -0,0 +1,305 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/viliproject/vili/config"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/slack"
+	"github.com/viliproject/vili/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// jobRunLogLines is the number of log lines that are saved when a job run
+// ends, so that they can be viewed after its pods are deleted
+const jobRunLogLines = 1000
+
+// jobRunResultSummaryLength is the maximum length of the summary of a job run
+// result in messages
+const jobRunResultSummaryLength = 200
+
+// finish records the outcome of the run and saves its logs
+func (r *JobRun) finish(runErr error) {
+	endedAt := time.Now()
+	r.EndedAt = &endedAt
+	r.Status = types.JobRunStatusSucceeded
+	if runErr != nil {
+		r.Status = types.JobRunStatusFailed
+	}
+
+	if r.Attempts == nil {
+		r.readAttempts()
+	}
+	r.ExitReason = getJobRunExitReason(runErr)
+	if r.CancelledBy == "" {
+		// the run may have been cancelled after the watch ended
+		if saved, err := getJobRunValue(r.Env, r.JobName, r.ID); err == nil && saved != nil {
+			r.CancelledBy = saved.CancelledBy
+		}
+	}
+	if r.CancelledBy != "" {
+		r.Status = types.JobRunStatusCancelled
+		r.ExitReason = "Cancelled by " + r.CancelledBy
+	}
+	if r.ExitReason == "" && len(r.Attempts) > 0 {
+		r.ExitReason = r.Attempts[len(r.Attempts)-1].exitReason()
+	}
+	pod, err := r.getLatestPod()
+	if err != nil {
+		log.WithError(err).Warn("failed getting job run pod")
+	}
+	if err := r.saveLogs(pod); err != nil {
+		log.WithError(err).Warn("failed saving job run logs")
+	}
+	if err := setJobRunValue(r); err != nil {
+		log.WithError(err).Error("failed saving job run")
+	}
+}
+
+// getJobRunExitReason describes why the job was stopped by vili, if it was
+func getJobRunExitReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	switch err.Error() {
+	case "deleted":
+		return "Deleted"
+	case "timeout":
+		return "Timeout"
+	}
+	return ""
+}
+
+// JobRunAttempt is a pod that ran the job, with the exit code, reason and
+// termination message of its container
+type JobRunAttempt struct {
+	Pod      string `json:"pod"`
+	ExitCode int32  `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+func (a *JobRunAttempt) exitReason() string {
+	if a.ExitCode == 0 {
+		return a.Reason
+	}
+	return fmt.Sprintf("%s (exit code %d)", a.Reason, a.ExitCode)
+}
+
+// readAttempts reads the terminated containers of the pods of the run, and
+// the result of the run from the termination message of the last one. Jobs
+// report a result by writing a json object to their termination message path,
+// which is /dev/termination-log by default.
+func (r *JobRun) readAttempts() {
+	pods, err := kube.GetClient(r.Env).Pods().List(metav1.ListOptions{
+		LabelSelector: "run=" + r.RunName,
+	})
+	if err != nil {
+		log.WithError(err).Warn("failed getting job run pods")
+		return
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].ObjectMeta.CreationTimestamp.Before(&pods.Items[j].ObjectMeta.CreationTimestamp)
+	})
+	attempts := []*JobRunAttempt{}
+	for _, pod := range pods.Items {
+		if len(pod.Spec.Containers) == 0 {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			// the first container runs the job
+			if status.Name != pod.Spec.Containers[0].Name || status.State.Terminated == nil {
+				continue
+			}
+			attempts = append(attempts, &JobRunAttempt{
+				Pod:      pod.ObjectMeta.Name,
+				ExitCode: status.State.Terminated.ExitCode,
+				Reason:   status.State.Terminated.Reason,
+				Message:  strings.TrimSpace(status.State.Terminated.Message),
+			})
+		}
+	}
+	r.Attempts = attempts
+	r.Result = nil
+	if len(attempts) > 0 {
+		result := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(attempts[len(attempts)-1].Message), &result); err == nil {
+			r.Result = result
+		}
+	}
+}
+
+// logResultMessage logs the message with the summary of the result of the
+// run appended. The summary comes from the job, so it is escaped for slack.
+func (r *JobRun) logResultMessage(message string, level log.Level) {
+	summary := r.resultSummary()
+	if summary == "" {
+		r.logMessage(message, level)
+		return
+	}
+	r.logMessages(message+" - "+summary, message+" - "+slack.Escape(summary), level)
+}
+
+// resultSummary returns the "summary" or "message" field of the result of the
+// run, or else the result itself
+func (r *JobRun) resultSummary() string {
+	if len(r.Result) == 0 {
+		return ""
+	}
+	for _, key := range []string{"summary", "message"} {
+		if summary, ok := r.Result[key].(string); ok && summary != "" {
+			return summary
+		}
+	}
+	data, err := json.Marshal(r.Result)
+	if err != nil {
+		return ""
+	}
+	return truncateResultSummary(string(data))
+}
+
+// truncateResultSummary truncates the summary to jobRunResultSummaryLength
+// characters. It counts runes, so that multi-byte characters are not split.
+func truncateResultSummary(summary string) string {
+	runes := []rune(summary)
+	if len(runes) > jobRunResultSummaryLength {
+		return string(runes[:jobRunResultSummaryLength]) + "..."
+	}
+	return summary
+}
+
+// getLatestPod returns the most recently created pod of the run, or nil if
+// there are none
+func (r *JobRun) getLatestPod() (*corev1.Pod, error) {
+	pods, err := kube.GetClient(r.Env).Pods().List(metav1.ListOptions{
+		LabelSelector: "run=" + r.RunName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var latestPod *corev1.Pod
+	for ix, pod := range pods.Items {
+		if latestPod == nil || pod.ObjectMeta.CreationTimestamp.After(latestPod.ObjectMeta.CreationTimestamp.Time) {
+			latestPod = &pods.Items[ix]
+		}
+	}
+	return latestPod, nil
+}
+
+// saveLogs saves the last log lines of the first container of the pod
+func (r *JobRun) saveLogs(pod *corev1.Pod) error {
+	if pod == nil || len(pod.Spec.Containers) == 0 {
+		return nil
+	}
+	tailLines := int64(jobRunLogLines)
+	output, err := kube.GetClient(r.Env).Pods().GetLogs(pod.ObjectMeta.Name, &corev1.PodLogOptions{
+		Container: pod.Spec.Containers[0].Name,
+		TailLines: &tailLines,
+	}).DoRaw()
+	if err != nil {
+		return err
+	}
+	return redis.GetClient().HSet(jobRunsRedisKey(r.Env, r.JobName)+":logs", r.ID, string(output)).Err()
+}
+
+func jobRunsRedisKey(env, jobName string) string {
+	return fmt.Sprintf("jobruns:%s:%s", env, jobName)
+}
+
+// createJobRunValue saves the run and trims the run history for the job to
+// the configured size
+func createJobRunValue(r *JobRun) error {
+	key := jobRunsRedisKey(r.Env, r.JobName)
+	client := redis.GetClient()
+	if err := setJobRunValue(r); err != nil {
+		return err
+	}
+	if err := client.LPush(key+":ids", r.ID).Err(); err != nil {
+		return err
+	}
+
+	historySize := int64(config.GetInt(config.JobRunHistorySize))
+	expiredIDs, err := client.LRange(key+":ids", historySize, -1).Result()
+	if err != nil {
+		return err
+	}
+	if len(expiredIDs) > 0 {
+		if err := client.HDel(key, expiredIDs...).Err(); err != nil {
+			return err
+		}
+		if err := client.HDel(key+":logs", expiredIDs...).Err(); err != nil {
+			return err
+		}
+	}
+	return client.LTrim(key+":ids", 0, historySize-1).Err()
+}
+
+func setJobRunValue(r *JobRun) error {
+	// the job object and logs are not stored with the run history
+	record := *r
+	record.Job = nil
+	record.Logs = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return redis.GetClient().HSet(jobRunsRedisKey(r.Env, r.JobName), r.ID, string(data)).Err()
+}
+
+func getJobRunValue(env, jobName, id string) (*JobRun, error) {
+	data, err := redis.GetClient().HGet(jobRunsRedisKey(env, jobName), id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	run := new(JobRun)
+	return run, json.Unmarshal([]byte(data), run)
+}
+
+func getJobRunLogs(env, jobName, id string) (string, error) {
+	logs, err := redis.GetClient().HGet(jobRunsRedisKey(env, jobName)+":logs", id).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return strings.TrimSpace(logs), err
+}
+
+// listJobRunValues returns the run history for the job, newest first
+func listJobRunValues(env, jobName string) ([]*JobRun, error) {
+	key := jobRunsRedisKey(env, jobName)
+	client := redis.GetClient()
+	ids, err := client.LRange(key+":ids", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	runs := []*JobRun{}
+	if len(ids) == 0 {
+		return runs, nil
+	}
+	values, err := client.HMGet(key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		run := new(JobRun)
+		if err := json.Unmarshal([]byte(data), run); err != nil {
+			log.WithError(err).Warn("error parsing job run json")
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// jobRunLeaseTTL is how long a job run stays leased to the replica
+	// watching it after the replica stops renewing the lease
+	jobRunLeaseTTL = time.Minute
+	// jobRunResumeInterval is how often every replica looks for job runs
+	// that are running but not leased
+	jobRunResumeInterval = 30 * time.Second
+)
+
+// ResumeJobRuns resumes watching job runs that are still running but are not
+// watched by any replica, for example because the replica that started them
+// was restarted, until the server exits. Runs whose jobs exited in the
+// meantime are recorded as soon as they are resumed.
+func ResumeJobRuns() {
+	ticker := time.NewTicker(jobRunResumeInterval)
+	defer ticker.Stop()
+	for {
+		for _, environment := range environments.Environments() {
+			if err := resumeJobRuns(environment.Name); err != nil {
+				log.WithError(err).Errorf("failed resuming job runs for %s", environment.Name)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ExitingChan:
+			return
+		}
+	}
+}
+
+func resumeJobRuns(env string) error {
+	jobs, err := kube.GetClient(env).Jobs().List(metav1.ListOptions{
+		LabelSelector: "job,run",
+	})
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs.Items {
+		jobName := job.ObjectMeta.Labels["job"]
+		run, err := getJobRunValue(env, jobName, strings.TrimPrefix(job.ObjectMeta.Name, jobName+"-"))
+		if err != nil {
+			return err
+		}
+		if run == nil || run.Status != types.JobRunStatusRunning {
+			continue
+		}
+		leased, err := acquireJobRunLease(run)
+		if err != nil {
+			return err
+		}
+		if !leased {
+			continue
+		}
+		run.logMessage("Resuming job run", log.InfoLevel)
+		go run.watch()
+	}
+	return nil
+}
+
+func acquireJobRunLease(r *JobRun) (bool, error) {
+	return redis.GetClient().SetNX(jobRunLeaseRedisKey(r), leaseOwner, jobRunLeaseTTL).Result()
+}
+
+// renewJobRunLease extends the lease of the job run until the stop channel is
+// closed
+func renewJobRunLease(r *JobRun, stop <-chan struct{}) {
+	ticker := time.NewTicker(jobRunLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := redis.GetClient().Set(jobRunLeaseRedisKey(r), leaseOwner, jobRunLeaseTTL).Err()
+			if err != nil {
+				log.WithError(err).Warn("failed renewing job run lease")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func releaseJobRunLease(r *JobRun) error {
+	key := jobRunLeaseRedisKey(r)
+	owner, err := redis.GetClient().Get(key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner != leaseOwner {
+		return nil
+	}
+	return redis.GetClient().Del(key).Err()
+}
+
+func jobRunLeaseRedisKey(r *JobRun) string {
+	return jobRunsRedisKey(r.Env, r.JobName) + ":" + r.ID + ":lease"
+}
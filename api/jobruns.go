@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/viliproject/vili/config"
@@ -14,53 +16,120 @@ import (
 	"github.com/viliproject/vili/server"
 	"github.com/viliproject/vili/session"
 	"github.com/viliproject/vili/templates"
+	"github.com/viliproject/vili/types"
 	"github.com/viliproject/vili/util"
 	"github.com/labstack/echo"
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
+// JobRunsGetResponse is a response to the get job runs request
+type JobRunsGetResponse struct {
+	Runs  []*JobRun `json:"runs"`
+	Total int       `json:"total"`
+}
+
 func jobRunsGetHandler(c echo.Context) error {
 	env := c.Param("env")
 	job := c.Param("job")
 
-	endpoint := kube.GetClient(env).Jobs()
-	query := getListOptionsFromRequest(c)
-	if query.LabelSelector != "" {
-		query.LabelSelector += ","
-	}
-	query.LabelSelector += "job=" + job
-
 	if c.Request().URL.Query().Get("watch") != "" {
+		// watch the jobs that are still in the cluster
+		endpoint := kube.GetClient(env).Jobs()
+		query := getListOptionsFromRequest(c)
+		if query.LabelSelector != "" {
+			query.LabelSelector += ","
+		}
+		query.LabelSelector += "job=" + job
 		return apiWatchWebsocket(c, query, endpoint.Watch)
 	}
 
-	// otherwise, return the pods list
-	resp, err := endpoint.List(query)
+	username := c.QueryParam("user")
+	status := types.JobRunStatus(c.QueryParam("status"))
+	runs, err := listJobRunValues(env, job)
 	if err != nil {
 		return err
 	}
+	filtered := []*JobRun{}
+	for _, run := range runs {
+		if username != "" && run.Username != username {
+			continue
+		}
+		if status != "" && run.Status != status {
+			continue
+		}
+		filtered = append(filtered, run)
+	}
+
+	offset, limit := getPaginationFromRequest(c)
+	resp := &JobRunsGetResponse{
+		Runs:  []*JobRun{},
+		Total: len(filtered),
+	}
+	if offset < len(filtered) {
+		end := offset + limit
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		resp.Runs = filtered[offset:end]
+	}
 	return c.JSON(http.StatusOK, resp)
 }
 
+// jobRunGetHandler returns the job run with its logs. The run can be given
+// by its id or by the name of its job object.
+func jobRunGetHandler(c echo.Context) error {
+	env := c.Param("env")
+	jobName := c.Param("job")
+	id := strings.TrimPrefix(c.Param("run"), jobName+"-")
+
+	run, err := getJobRunValue(env, jobName, id)
+	if err != nil {
+		return err
+	}
+	if run == nil {
+		return server.ErrorResponse(c, errors.NotFound("Job run not found"))
+	}
+	run.Logs, err = getJobRunLogs(env, jobName, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, run)
+}
+
+// jobRunCreateRequest is the body of the create job run request. The other
+// fields of the run are set by the server.
+type jobRunCreateRequest struct {
+	Branch     string            `json:"branch"`
+	Tag        string            `json:"tag"`
+	Parameters map[string]string `json:"parameters"`
+}
+
 func jobRunCreateHandler(c echo.Context) error {
 	env := c.Param("env")
 	jobName := c.Param("job")
 
-	jobRun := new(JobRun)
-	if err := json.NewDecoder(c.Request().Body).Decode(jobRun); err != nil {
+	createRequest := new(jobRunCreateRequest)
+	if err := json.NewDecoder(c.Request().Body).Decode(createRequest); err != nil {
 		return err
 	}
-	if jobRun.Branch == "" {
+	if createRequest.Branch == "" {
 		return server.ErrorResponse(c, errors.BadRequest("Request missing branch"))
 	}
-	if jobRun.Tag == "" {
+	if createRequest.Tag == "" {
 		return server.ErrorResponse(c, errors.BadRequest("Request missing tag"))
 	}
-	jobRun.Env = env
-	jobRun.JobName = jobName
-	jobRun.Username = c.Get("user").(*session.User).Username
+	jobRun := &JobRun{
+		Env:        env,
+		JobName:    jobName,
+		Branch:     createRequest.Branch,
+		Tag:        createRequest.Tag,
+		Username:   c.Get("user").(*session.User).Username,
+		Parameters: createRequest.Parameters,
+	}
 
 	err := jobRun.Run(c.Request().URL.Query().Get("async") != "")
 	if err != nil {
@@ -74,15 +143,35 @@ func jobRunCreateHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, jobRun)
 }
 
-// JobRun represents a single pod run
+// JobRun represents a single pod run. Time is when the run started, and
+// RunName is the name of its job object.
 type JobRun struct {
 	ID       string    `json:"id"`
 	Env      string    `json:"env"`
 	JobName  string    `json:"jobName"`
+	RunName  string    `json:"runName"`
 	Branch   string    `json:"branch"`
 	Tag      string    `json:"tag"`
 	Time     time.Time `json:"time"`
 	Username string    `json:"username"`
+	// Parameters are the values of the parameters declared by the job
+	// template. When the run is created they are the given values, and the
+	// defaults are filled in from the template.
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	Status     types.JobRunStatus `json:"status"`
+	EndedAt    *time.Time         `json:"endedAt,omitempty"`
+	ExitReason string             `json:"exitReason,omitempty"`
+	// Attempts are the pods that ran the job, oldest first, and Result is the
+	// json object in the termination message of the last one, if any
+	Attempts []*JobRunAttempt      `json:"attempts,omitempty"`
+	Result   map[string]interface{} `json:"result,omitempty"`
+	// RetryOf is the id of the run that this run retries
+	RetryOf     string `json:"retryOf,omitempty"`
+	CancelledBy string `json:"cancelledBy,omitempty"`
+	// Logs are the last lines of the logs of the run, which are saved when
+	// it ends
+	Logs string `json:"logs,omitempty"`
 
 	Job *batchv1.Job `json:"job"`
 }
@@ -91,6 +180,9 @@ type JobRun struct {
 func (r *JobRun) Run(async bool) error {
 	r.ID = util.RandLowercaseString(16)
 	r.Time = time.Now()
+	r.CancelledBy = ""
+	r.Attempts = nil
+	r.Result = nil
 
 	digest, err := repository.GetDockerTag(r.JobName, r.Tag)
 	if err != nil {
@@ -106,12 +198,42 @@ func (r *JobRun) Run(async bool) error {
 	if err != nil {
 		return err
 	}
+	r.Status = types.JobRunStatusRunning
+	// lease the run before saving it, so that no other replica resumes it
+	if _, err := acquireJobRunLease(r); err != nil {
+		log.WithError(err).Warn("failed leasing job run")
+	}
+	if err := createJobRunValue(r); err != nil {
+		log.WithError(err).Error("failed saving job run")
+	}
 
 	if async {
-		go r.watchJob()
+		go r.watch()
 		return nil
 	}
-	return r.watchJob()
+	return r.watch()
+}
+
+// watch waits for the job to exit and records its outcome. The run must be
+// leased to this replica, and the lease is released when it returns. If Vili
+// shuts down first, the run is left running so that another replica resumes
+// it.
+func (r *JobRun) watch() error {
+	stop := make(chan struct{})
+	go renewJobRunLease(r, stop)
+	defer func() {
+		close(stop)
+		if err := releaseJobRunLease(r); err != nil {
+			log.WithError(err).Warn("failed releasing job run lease")
+		}
+	}()
+
+	err := r.watchJob()
+	if err == errViliExiting {
+		return err
+	}
+	r.finish(err)
+	return err
 }
 
 func (r *JobRun) createNewJob() (err error) {
@@ -121,22 +243,37 @@ func (r *JobRun) createNewJob() (err error) {
 		return
 	}
 
-	job := new(batchv1.Job)
-	err = jobTemplate.Parse(job)
+	parameters, err := jobTemplate.Parameters()
 	if err != nil {
+		err = JobRunInitError{message: err.Error()}
 		return
 	}
+	r.Parameters, err = templates.ResolveParameters(parameters, r.Parameters)
+	if err != nil {
+		err = JobRunInitError{message: err.Error()}
+		return
+	}
+	if len(parameters) > 0 {
+		jobTemplate, err = jobTemplate.PopulateParameters(parameters, r.Parameters)
+		if err != nil {
+			return
+		}
+	}
 
-	containers := job.Spec.Template.Spec.Containers
-	if len(containers) == 0 {
-		return fmt.Errorf("no containers in job")
+	job := new(batchv1.Job)
+	err = jobTemplate.Parse(job)
+	if err != nil {
+		return
 	}
 
-	imageName, err := repository.DockerFullName(r.JobName, r.Tag)
+	err = setContainerImages(&job.Spec.Template.Spec, job.ObjectMeta.Annotations, r.JobName, r.Tag, nil)
 	if err != nil {
+		if e, ok := err.(containerImageError); ok {
+			err = JobRunInitError{message: e.Error()}
+		}
 		return
 	}
-	containers[0].Image = imageName
+	setJobParameterEnv(&job.Spec.Template.Spec, r.Parameters)
 
 	job.ObjectMeta.Name = r.JobName + "-" + r.ID
 
@@ -159,79 +296,173 @@ func (r *JobRun) createNewJob() (err error) {
 	job.Spec.Template.ObjectMeta.Annotations["vili/branch"] = r.Branch
 	job.ObjectMeta.Annotations["vili/startedBy"] = r.Username
 	job.Spec.Template.ObjectMeta.Annotations["vili/startedBy"] = r.Username
+	if len(r.Parameters) > 0 {
+		var parameterValues []byte
+		parameterValues, err = json.Marshal(r.Parameters)
+		if err != nil {
+			return
+		}
+		job.ObjectMeta.Annotations["vili/parameterValues"] = string(parameterValues)
+		job.Spec.Template.ObjectMeta.Annotations["vili/parameterValues"] = string(parameterValues)
+	}
+
+	err = r.applyConcurrencyPolicy(job)
+	defer func() {
+		if err := r.unlockJobRuns(); err != nil {
+			log.WithError(err).Warn("failed unlocking job runs")
+		}
+	}()
+	if err != nil {
+		return
+	}
 
 	newJob, err := kube.GetClient(r.Env).Jobs().Create(job)
 	if err != nil {
 		return
 	}
 	r.Job = newJob
+	r.RunName = newJob.ObjectMeta.Name
 	r.logMessage(fmt.Sprintf("Job for tag %s and branch %s created by %s", r.Tag, r.Branch, r.Username), log.InfoLevel)
 	return
 }
 
-// watchJob waits until the job exits
-func (r *JobRun) watchJob() (err error) {
-	watcher, err := kube.GetClient(r.Env).Jobs().Watch(metav1.ListOptions{
-		FieldSelector: "metadata.name=" + r.Job.ObjectMeta.Name,
-	})
-	if err != nil {
-		return
+// watchJob waits until the job exits. The api server closes watches after a
+// while, so the job is read again whenever the watch ends, and its conditions
+// decide whether it exited or has to be watched again.
+func (r *JobRun) watchJob() error {
+	endpoint := kube.GetClient(r.Env).Jobs()
+	timeout := time.After(config.GetDuration(config.JobRunTimeout) - time.Since(r.Time))
+	for {
+		job, err := endpoint.Get(r.RunName, metav1.GetOptions{})
+		if err != nil {
+			if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+				r.logMessage(fmt.Sprintf("Deleted job after %s", humanizeDuration(time.Since(r.Time))), log.WarnLevel)
+				return fmt.Errorf("deleted")
+			}
+			return err
+		}
+		r.Job = job
+		if finished, err := r.checkJobFinished(job); finished {
+			return err
+		}
+
+		watcher, err := endpoint.Watch(metav1.ListOptions{
+			FieldSelector:   "metadata.name=" + r.RunName,
+			ResourceVersion: job.ObjectMeta.ResourceVersion,
+		})
+		if err != nil {
+			return err
+		}
+		finished, err := r.watchJobEvents(watcher, timeout)
+		watcher.Stop()
+		if finished {
+			return err
+		}
 	}
+}
 
-	startTime := time.Now()
-eventLoop:
+// watchJobEvents waits until the job exits or the watch ends, and returns
+// whether the job exited
+func (r *JobRun) watchJobEvents(watcher watch.Interface, timeout <-chan time.Time) (bool, error) {
 	for {
 		select {
 		case event, ok := <-watcher.ResultChan():
 			if !ok {
-				break eventLoop
+				return false, nil
+			}
+			job, ok := event.Object.(*batchv1.Job)
+			if !ok {
+				// error events end the watch
+				return false, nil
 			}
-			elapsed := time.Now().Sub(startTime)
-			job := event.Object.(*batchv1.Job)
 			switch event.Type {
 			case watch.Deleted:
-				r.logMessage(fmt.Sprintf("Deleted job after %s", humanizeDuration(elapsed)), log.WarnLevel)
-				watcher.Stop()
-				err = fmt.Errorf("deleted")
-				break eventLoop
-			case watch.Added, watch.Modified:
-				finished := false
-				for _, condition := range job.Status.Conditions {
-					switch condition.Type {
-					case batchv1.JobComplete:
-						elapsed := time.Now().Sub(startTime)
-						r.logMessage(fmt.Sprintf("Successfully completed job in %s", humanizeDuration(elapsed)), log.InfoLevel)
-						finished = true
-					case batchv1.JobFailed:
-						elapsed := time.Now().Sub(startTime)
-						r.logMessage(fmt.Sprintf("Failed job after %s", humanizeDuration(elapsed)), log.ErrorLevel)
-						finished = true
-						err = fmt.Errorf("failed")
-					}
+				elapsed := time.Since(r.Time)
+				r.CancelledBy = job.ObjectMeta.Annotations[jobRunCancelledByAnnotation]
+				if r.CancelledBy != "" {
+					r.logMessage(fmt.Sprintf("Job cancelled by %s after %s", r.CancelledBy, humanizeDuration(elapsed)), log.WarnLevel)
+				} else {
+					r.logMessage(fmt.Sprintf("Deleted job after %s", humanizeDuration(elapsed)), log.WarnLevel)
 				}
-				if finished {
-					watcher.Stop()
-					break eventLoop
+				return true, fmt.Errorf("deleted")
+			case watch.Added, watch.Modified:
+				if finished, err := r.checkJobFinished(job); finished {
+					return true, err
 				}
 			}
-		case <-time.After(config.GetDuration(config.JobRunTimeout)):
-			elapsed := time.Now().Sub(startTime)
-			r.logMessage(fmt.Sprintf("Job timed out after %s", humanizeDuration(elapsed)), log.WarnLevel)
-			watcher.Stop()
-			err = fmt.Errorf("timeout")
-			break eventLoop
+		case <-timeout:
+			r.logMessage(fmt.Sprintf("Job timed out after %s", humanizeDuration(time.Since(r.Time))), log.WarnLevel)
+			return true, fmt.Errorf("timeout")
+		case <-ExitingChan:
+			return true, errViliExiting
+		}
+	}
+}
+
+// checkJobFinished returns whether the job completed or failed, and an error
+// if it failed
+func (r *JobRun) checkJobFinished(job *batchv1.Job) (bool, error) {
+	for _, condition := range job.Status.Conditions {
+		switch condition.Type {
+		case batchv1.JobComplete:
+			r.readAttempts()
+			r.logResultMessage(fmt.Sprintf("Successfully completed job in %s", humanizeDuration(time.Since(r.Time))), log.InfoLevel)
+			return true, nil
+		case batchv1.JobFailed:
+			r.readAttempts()
+			r.logResultMessage(fmt.Sprintf("Failed job after %s", humanizeDuration(time.Since(r.Time))), log.ErrorLevel)
+			return true, fmt.Errorf("failed")
+		}
+	}
+	return false, nil
+}
+
+// jobParameterEnvPrefix is prepended to the names of the environment
+// variables of job parameters, so that they do not replace the environment
+// variables of the containers, such as PATH
+const jobParameterEnvPrefix = "PARAM_"
+
+// setJobParameterEnv sets an environment variable with the prefixed upper case
+// name of each parameter in every container, so that args can refer to the
+// parameters as $(PARAM_NAME)
+func setJobParameterEnv(spec *corev1.PodSpec, parameters map[string]string) {
+	names := []string{}
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for ix := range spec.Containers {
+		container := &spec.Containers[ix]
+		envIndexes := map[string]int{}
+		for envIx, envVar := range container.Env {
+			envIndexes[envVar.Name] = envIx
+		}
+		for _, name := range names {
+			envVar := corev1.EnvVar{
+				Name:  jobParameterEnvPrefix + strings.ToUpper(name),
+				Value: parameters[name],
+			}
+			if envIx, ok := envIndexes[envVar.Name]; ok {
+				container.Env[envIx] = envVar
+				continue
+			}
+			container.Env = append(container.Env, envVar)
 		}
 	}
-	return
 }
 
 func (r *JobRun) logMessage(message string, level log.Level) {
+	r.logMessages(message, message, level)
+}
+
+// logMessages logs the message, and posts the slack text to slack
+func (r *JobRun) logMessages(message, slackText string, level log.Level) {
 	urlStr := fmt.Sprintf(
 		"%s/%s/jobs/%s/runs/%s",
 		config.GetString(config.URI),
 		r.Env,
 		r.JobName,
-		r.Job.ObjectMeta.Name,
+		r.RunName,
 	)
 	slackMessage := fmt.Sprintf(
 		"*%s* - *%s* - <%s|%s> - %s",
@@ -239,7 +470,7 @@ func (r *JobRun) logMessage(message string, level log.Level) {
 		r.JobName,
 		urlStr,
 		r.ID,
-		message,
+		slackText,
 	)
 	jobMessage := fmt.Sprintf(
 		"%s - %s - %s",
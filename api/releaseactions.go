@@ -0,0 +1,282 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/slack"
+	"github.com/viliproject/vili/templates"
+	"github.com/viliproject/vili/types"
+	"github.com/asaskevich/govalidator"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// releaseActionWebhookTimeout is the timeout of the requests made by the
+// runWebhook release action
+const releaseActionWebhookTimeout = 30 * time.Second
+
+// releaseAction is an action that can be run as a release target
+type releaseAction struct {
+	// params maps the names of the parameters of the action to whether they
+	// are required
+	params map[string]bool
+	// validate checks the values of the parameters, which are known to
+	// include the required ones
+	validate func(params map[string]string) error
+	// run runs the action and returns a description of the result
+	run func(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error)
+}
+
+// releaseActions are the actions that release targets of type "action" can
+// run, by name
+var releaseActions = map[string]*releaseAction{
+	"syncConfigMaps": &releaseAction{
+		run: syncConfigMapsAction,
+	},
+	"syncServices": &releaseAction{
+		run: syncServicesAction,
+	},
+	"runWebhook": &releaseAction{
+		params: map[string]bool{
+			"url":    true,
+			"method": false,
+			"body":   false,
+		},
+		validate: validateWebhookAction,
+		run:      runWebhookAction,
+	},
+	"waitForDuration": &releaseAction{
+		params: map[string]bool{
+			"duration": true,
+		},
+		validate: validateWaitForDurationAction,
+		run:      waitForDurationAction,
+	},
+	"scaleDeployment": &releaseAction{
+		params: map[string]bool{
+			"deployment": true,
+			"replicas":   true,
+		},
+		validate: validateScaleDeploymentAction,
+		run:      scaleDeploymentAction,
+	},
+	"notify": &releaseAction{
+		params: map[string]bool{
+			"message": true,
+			"level":   false,
+		},
+		validate: validateNotifyAction,
+		run:      notifyAction,
+	},
+}
+
+// validateReleaseAction checks that the action of the target exists and that
+// its parameters are valid
+func validateReleaseAction(target *types.ReleaseTarget) error {
+	action, ok := releaseActions[target.Name]
+	if !ok {
+		names := []string{}
+		for name := range releaseActions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown action %s, expected one of %s", target.Name, strings.Join(names, ", "))
+	}
+	for param := range target.Params {
+		if _, ok := action.params[param]; !ok {
+			return fmt.Errorf("unknown parameter %s for action %s", param, target.Name)
+		}
+	}
+	for param, required := range action.params {
+		if required && target.Params[param] == "" {
+			return fmt.Errorf("missing parameter %s for action %s", param, target.Name)
+		}
+	}
+	if action.validate != nil {
+		if err := action.validate(target.Params); err != nil {
+			return fmt.Errorf("invalid parameters for action %s: %s", target.Name, err)
+		}
+	}
+	return nil
+}
+
+// syncConfigMapsAction creates or updates every configmap from its template
+func syncConfigMapsAction(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	configmapNames, err := templates.ConfigMaps(releaseRollout.Env, target.Branch)
+	if err != nil {
+		return "", err
+	}
+	for _, configmapName := range configmapNames {
+		if err := syncConfigMap(releaseRollout.Env, target.Branch, configmapName); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("synced %d configmaps", len(configmapNames)), nil
+}
+
+// syncServicesAction creates the missing services for deployments that
+// expose a port
+func syncServicesAction(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	deploymentNames, err := templates.Deployments(releaseRollout.Env, target.Branch)
+	if err != nil {
+		return "", err
+	}
+	endpoint := kube.GetClient(releaseRollout.Env).Services()
+	created := []string{}
+	for _, deploymentName := range deploymentNames {
+		_, err := endpoint.Get(deploymentName, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if statusError, ok := err.(*kubeErrors.StatusError); !ok || statusError.Status().Code != http.StatusNotFound {
+			return "", err
+		}
+		deploymentTemplate, err := templates.Deployment(releaseRollout.Env, target.Branch, deploymentName)
+		if err != nil {
+			return "", err
+		}
+		deployment := new(extv1beta1.Deployment)
+		if err := deploymentTemplate.Parse(deployment); err != nil {
+			return "", err
+		}
+		deploymentPort, err := getPortFromDeployment(deployment)
+		if err != nil {
+			// deployments without ports do not need a service
+			continue
+		}
+		if _, err := endpoint.Create(newDeploymentService(deploymentName, deploymentPort)); err != nil {
+			return "", err
+		}
+		created = append(created, deploymentName)
+	}
+	if len(created) == 0 {
+		return "no services created", nil
+	}
+	return fmt.Sprintf("created services %s", strings.Join(created, ", ")), nil
+}
+
+func validateWebhookAction(params map[string]string) error {
+	if !govalidator.IsURL(params["url"]) {
+		return fmt.Errorf("url %s is not valid", params["url"])
+	}
+	switch params["method"] {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut:
+		return nil
+	default:
+		return fmt.Errorf("method must be one of GET, POST or PUT")
+	}
+}
+
+// runWebhookAction makes a request to the url and fails unless the response
+// status is 2xx
+func runWebhookAction(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	method := target.Params["method"]
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, target.Params["url"], strings.NewReader(target.Params["body"]))
+	if err != nil {
+		return "", err
+	}
+	if target.Params["body"] != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Timeout: releaseActionWebhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return fmt.Sprintf("webhook responded with %s", resp.Status), nil
+}
+
+func validateWaitForDurationAction(params map[string]string) error {
+	duration, err := time.ParseDuration(params["duration"])
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	return nil
+}
+
+// waitForDurationAction waits for the duration, for example to let metrics
+// settle between waves
+func waitForDurationAction(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	duration, err := time.ParseDuration(target.Params["duration"])
+	if err != nil {
+		return "", err
+	}
+	select {
+	case <-time.After(duration):
+		return fmt.Sprintf("waited %s", duration), nil
+	case <-ExitingChan:
+		return "", errViliExiting
+	}
+}
+
+func validateScaleDeploymentAction(params map[string]string) error {
+	replicas, err := strconv.Atoi(params["replicas"])
+	if err != nil || replicas < 0 {
+		return fmt.Errorf("replicas must be a non-negative integer")
+	}
+	return nil
+}
+
+// scaleDeploymentAction sets the number of replicas of the deployment
+func scaleDeploymentAction(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	deploymentName := target.Params["deployment"]
+	replicas, err := strconv.Atoi(target.Params["replicas"])
+	if err != nil {
+		return "", err
+	}
+	kubeClient := kube.GetClient(releaseRollout.Env)
+	_, err = kubeClient.Deployments().UpdateScale(deploymentName, &extv1beta1.Scale{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deploymentName,
+			Namespace: kubeClient.Namespace(),
+		},
+		Spec: extv1beta1.ScaleSpec{
+			Replicas: int32(replicas),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("scaled %s to %d replicas", deploymentName, replicas), nil
+}
+
+var notifyActionLevels = map[string]log.Level{
+	"":      log.InfoLevel,
+	"info":  log.InfoLevel,
+	"warn":  log.WarnLevel,
+	"error": log.ErrorLevel,
+}
+
+func validateNotifyAction(params map[string]string) error {
+	if _, ok := notifyActionLevels[params["level"]]; !ok {
+		return fmt.Errorf("level must be one of info, warn or error")
+	}
+	return nil
+}
+
+// notifyAction posts the message to slack
+func notifyAction(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	slackMessage := fmt.Sprintf("release rollout in *%s*: %s", releaseRollout.Env, target.Params["message"])
+	if err := slack.PostLogMessage(slackMessage, notifyActionLevels[target.Params["level"]]); err != nil {
+		return "", err
+	}
+	return "posted to slack", nil
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/repository"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Release target changes
+const (
+	releaseTargetUpgrade   = "upgrade"
+	releaseTargetDowngrade = "downgrade"
+	releaseTargetNoop      = "noop"
+	releaseTargetChanged   = "changed"
+	releaseTargetMissing   = "missing"
+)
+
+// ReleaseDiffResponse is the response to the release diff request
+type ReleaseDiffResponse struct {
+	Release string               `json:"release"`
+	Against string               `json:"against"`
+	Targets []*ReleaseTargetDiff `json:"targets"`
+}
+
+// ReleaseTargetDiff compares the version of a release target with the version
+// that is live in the environment or in another release. The change is
+// "changed" if the order of the versions is unknown, and "missing" if the
+// target does not exist in the environment or the other release.
+type ReleaseTargetDiff struct {
+	Type       types.ReleaseTargetType `json:"type"`
+	Name       string                  `json:"name"`
+	Change     string                  `json:"change"`
+	Branch     string                  `json:"branch"`
+	Tag        string                  `json:"tag"`
+	FromBranch string                  `json:"fromBranch,omitempty"`
+	FromTag    string                  `json:"fromTag,omitempty"`
+}
+
+// releaseDiffHandler compares the app and job targets of a release with the
+// live deployments and latest job runs in the environment, or with another
+// release if the release query parameter is set
+func releaseDiffHandler(c echo.Context) error {
+	env := c.Param("env")
+	name := c.Param("release")
+	otherName := c.QueryParam("release")
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+	releaseEnv := environment.DeployedToEnv
+	if releaseEnv == "" {
+		releaseEnv = env
+	}
+	release, err := getReleaseValue(releaseEnv, name)
+	if err != nil {
+		return err
+	}
+	if release.Name == "" {
+		return errors.NotFound("Release not found")
+	}
+
+	resp := &ReleaseDiffResponse{
+		Release: release.Name,
+		Against: env,
+		Targets: []*ReleaseTargetDiff{},
+	}
+	var getFromTarget func(target *types.ReleaseTarget) (*types.ReleaseTarget, error)
+	if otherName != "" {
+		otherRelease, err := getReleaseValue(releaseEnv, otherName)
+		if err != nil {
+			return err
+		}
+		if otherRelease.Name == "" {
+			return errors.NotFound(fmt.Sprintf("Release %s not found", otherName))
+		}
+		resp.Against = otherRelease.Name
+		getFromTarget = func(target *types.ReleaseTarget) (*types.ReleaseTarget, error) {
+			return findReleaseTarget(otherRelease, target.Type, target.Name), nil
+		}
+	} else {
+		getFromTarget = func(target *types.ReleaseTarget) (*types.ReleaseTarget, error) {
+			return getLiveReleaseTarget(env, target)
+		}
+	}
+
+	for _, wave := range release.Waves {
+		for _, target := range wave.Targets {
+			if target.Type == types.ReleaseTargetTypeApp || target.Type == types.ReleaseTargetTypeJob {
+				resp.Targets = append(resp.Targets, &ReleaseTargetDiff{
+					Type:   target.Type,
+					Name:   target.Name,
+					Branch: target.Branch,
+					Tag:    target.Tag,
+				})
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failed bool
+	setFailed := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failed = true
+	}
+	for _, targetDiff := range resp.Targets {
+		wg.Add(1)
+		go func(targetDiff *ReleaseTargetDiff) {
+			defer wg.Done()
+			fromTarget, err := getFromTarget(&types.ReleaseTarget{
+				Type:   targetDiff.Type,
+				Name:   targetDiff.Name,
+				Branch: targetDiff.Branch,
+				Tag:    targetDiff.Tag,
+			})
+			if err != nil {
+				log.WithError(err).Error("failed getting release target to compare")
+				setFailed()
+				return
+			}
+			if err := diffReleaseTarget(targetDiff, fromTarget); err != nil {
+				log.WithError(err).Error("failed comparing release target")
+				setFailed()
+			}
+		}(targetDiff)
+	}
+	wg.Wait()
+	if failed {
+		return errors.InternalServerError()
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func findReleaseTarget(release *types.Release, targetType types.ReleaseTargetType, name string) *types.ReleaseTarget {
+	for _, wave := range release.Waves {
+		for _, target := range wave.Targets {
+			if target.Type == targetType && target.Name == name {
+				return target
+			}
+		}
+	}
+	return nil
+}
+
+// getLiveReleaseTarget returns the version of the deployment, or of the most
+// recent run of the job, in the environment. It returns nil if there is none.
+func getLiveReleaseTarget(env string, target *types.ReleaseTarget) (*types.ReleaseTarget, error) {
+	liveTarget := &types.ReleaseTarget{
+		Type: target.Type,
+		Name: target.Name,
+	}
+	switch target.Type {
+	case types.ReleaseTargetTypeApp:
+		deployment, err := kube.GetClient(env).Deployments().Get(target.Name, metav1.GetOptions{})
+		if err != nil {
+			if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+		liveTarget.Tag, err = getImageTagFromDeployment(deployment)
+		if err != nil {
+			return nil, err
+		}
+		liveTarget.Branch = deployment.ObjectMeta.Annotations["vili/branch"]
+	case types.ReleaseTargetTypeJob:
+		jobs, err := kube.GetClient(env).Jobs().List(metav1.ListOptions{
+			LabelSelector: "job=" + target.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs.Items) == 0 {
+			return nil, nil
+		}
+		latestJob := jobs.Items[0]
+		for _, job := range jobs.Items[1:] {
+			if job.ObjectMeta.CreationTimestamp.After(latestJob.ObjectMeta.CreationTimestamp.Time) {
+				latestJob = job
+			}
+		}
+		liveTarget.Tag, err = getImageTagFromContainers(latestJob.Spec.Template.Spec.Containers)
+		if err != nil {
+			return nil, err
+		}
+		liveTarget.Branch = latestJob.ObjectMeta.Annotations["vili/branch"]
+	}
+	return liveTarget, nil
+}
+
+// diffReleaseTarget sets the change of the target diff, ordering the versions
+// by the time their images were pushed
+func diffReleaseTarget(targetDiff *ReleaseTargetDiff, fromTarget *types.ReleaseTarget) error {
+	if fromTarget == nil {
+		targetDiff.Change = releaseTargetMissing
+		return nil
+	}
+	targetDiff.FromBranch = fromTarget.Branch
+	targetDiff.FromTag = fromTarget.Tag
+	if fromTarget.Tag == targetDiff.Tag {
+		targetDiff.Change = releaseTargetNoop
+		return nil
+	}
+
+	targetDiff.Change = releaseTargetChanged
+	branches := []string{}
+	for _, branch := range []string{targetDiff.Branch, fromTarget.Branch} {
+		if branch != "" && (len(branches) == 0 || branches[0] != branch) {
+			branches = append(branches, branch)
+		}
+	}
+	if len(branches) == 0 {
+		return nil
+	}
+	images, err := repository.GetDockerRepository(targetDiff.Name, branches)
+	if err != nil {
+		return err
+	}
+	var toImage, fromImage *repository.Image
+	for _, image := range images {
+		switch image.Tag {
+		case targetDiff.Tag:
+			toImage = image
+		case fromTarget.Tag:
+			fromImage = image
+		}
+	}
+	if toImage == nil || fromImage == nil {
+		return nil
+	}
+	if toImage.LastModified.After(fromImage.LastModified) {
+		targetDiff.Change = releaseTargetUpgrade
+	} else if toImage.LastModified.Before(fromImage.LastModified) {
+		targetDiff.Change = releaseTargetDowngrade
+	}
+	return nil
+}
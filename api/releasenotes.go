@@ -0,0 +1,159 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/viliproject/vili/config"
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/git"
+	"github.com/viliproject/vili/repository"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+)
+
+// releaseNotesSlackCommits is the maximum number of commits per target that
+// are listed in the slack message for a new release
+const releaseNotesSlackCommits = 10
+
+func releaseNotesGetHandler(c echo.Context) error {
+	env := c.Param("env")
+	name := c.Param("release")
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+	releaseEnv := environment.DeployedToEnv
+	if releaseEnv == "" {
+		releaseEnv = env
+	}
+	release, err := getReleaseValue(releaseEnv, name)
+	if err != nil {
+		return err
+	}
+	if release.Name == "" {
+		return errors.NotFound("Release not found")
+	}
+	notes := release.Notes
+	if notes == nil {
+		notes = []*types.ReleaseNote{}
+	}
+	return c.JSON(http.StatusOK, notes)
+}
+
+// generateReleaseNotes sets the notes of the release to the commits of each
+// app and job target between the revision that is live in the target
+// environment and the revision in the release. Targets whose commits cannot
+// be listed get a note with an error, so that they do not block the release.
+func generateReleaseNotes(release *types.Release) {
+	targetRepos := config.GetStringSliceMap(config.GithubTargetRepos)
+	notes := []*types.ReleaseNote{}
+	targets := []*types.ReleaseTarget{}
+	for _, wave := range release.Waves {
+		for _, target := range wave.Targets {
+			if target.Type == types.ReleaseTargetTypeApp || target.Type == types.ReleaseTargetTypeJob {
+				notes = append(notes, &types.ReleaseNote{
+					Type:    target.Type,
+					Name:    target.Name,
+					Commits: []*types.ReleaseNoteCommit{},
+				})
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for ix, note := range notes {
+		wg.Add(1)
+		go func(note *types.ReleaseNote, target *types.ReleaseTarget) {
+			defer wg.Done()
+			if err := populateReleaseNote(note, release.TargetEnv, target, targetRepos[target.Name]); err != nil {
+				note.Error = err.Error()
+			}
+		}(note, targets[ix])
+	}
+	wg.Wait()
+	release.Notes = notes
+}
+
+func populateReleaseNote(note *types.ReleaseNote, env string, target *types.ReleaseTarget, repo string) error {
+	liveTarget, err := getLiveReleaseTarget(env, target)
+	if err != nil {
+		return err
+	}
+	if liveTarget == nil {
+		return fmt.Errorf("%s is not deployed in %s", target.Name, env)
+	}
+	if liveTarget.Tag == target.Tag {
+		return nil
+	}
+
+	branches := []string{}
+	for _, branch := range []string{target.Branch, liveTarget.Branch} {
+		if branch != "" && (len(branches) == 0 || branches[0] != branch) {
+			branches = append(branches, branch)
+		}
+	}
+	images, err := repository.GetDockerRepository(target.Name, branches)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		switch image.Tag {
+		case target.Tag:
+			note.ToRevision = image.Revision
+		case liveTarget.Tag:
+			note.FromRevision = image.Revision
+		}
+	}
+	if note.FromRevision == "" || note.ToRevision == "" {
+		return fmt.Errorf("revisions of %s and %s not found", liveTarget.Tag, target.Tag)
+	}
+
+	commits, err := git.Commits(repo, note.FromRevision, note.ToRevision)
+	if err != nil {
+		return err
+	}
+	for _, commit := range commits {
+		note.Commits = append(note.Commits, &types.ReleaseNoteCommit{
+			SHA:              commit.SHA,
+			Message:          commit.Message,
+			Author:           commit.Author,
+			URL:              commit.URL,
+			PullRequest:      commit.PullRequest,
+			PullRequestTitle: commit.PullRequestTitle,
+		})
+	}
+	return nil
+}
+
+// releaseNotesSlackMessage returns a summary of the release notes for slack,
+// listing pull request titles where available
+func releaseNotesSlackMessage(notes []*types.ReleaseNote) string {
+	lines := []string{}
+	for _, note := range notes {
+		if note.Error != "" {
+			lines = append(lines, fmt.Sprintf("*%s*: no release notes (%s)", note.Name, note.Error))
+			continue
+		}
+		if len(note.Commits) == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("*%s*: %d commits", note.Name, len(note.Commits)))
+		for ix, commit := range note.Commits {
+			if ix == releaseNotesSlackCommits {
+				lines = append(lines, fmt.Sprintf("    and %d more", len(note.Commits)-ix))
+				break
+			}
+			line := commit.Message
+			if commit.PullRequestTitle != "" {
+				line = fmt.Sprintf("%s (#%d)", commit.PullRequestTitle, commit.PullRequest)
+			}
+			lines = append(lines, fmt.Sprintf("    • %s - %s", line, commit.Author))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,287 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/viliproject/vili/config"
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/releases"
+	"github.com/viliproject/vili/types"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// releaseRolloutLeaseTTL is how long a release rollout stays leased to
+	// the replica running it after the replica stops renewing the lease
+	releaseRolloutLeaseTTL = time.Minute
+	// releaseRolloutResumeInterval is how often every replica looks for
+	// release rollouts that are in progress but not leased
+	releaseRolloutResumeInterval = 30 * time.Second
+	// releaseRolloutResumeMaxAge is the age after which interrupted release
+	// rollouts are marked failed instead of resumed
+	releaseRolloutResumeMaxAge = 24 * time.Hour
+)
+
+// ResumeReleaseRollouts resumes release rollouts that were interrupted, for
+// example because the replica that ran them was restarted, until the server
+// exits. Rollouts that are in progress are leased to the replica running them,
+// so only rollouts without a lease are resumed.
+func ResumeReleaseRollouts() {
+	ticker := time.NewTicker(releaseRolloutResumeInterval)
+	defer ticker.Stop()
+	for {
+		for _, environment := range environments.Environments() {
+			if err := resumeReleaseRollouts(environment.Name); err != nil {
+				log.WithError(err).Errorf("failed resuming release rollouts for %s", environment.Name)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ExitingChan:
+			return
+		}
+	}
+}
+
+func resumeReleaseRollouts(env string) error {
+	releaseList, err := releases.List(env)
+	if err != nil {
+		return err
+	}
+	for _, release := range releaseList {
+		if err := resumeReleaseRollout(release); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeReleaseRollout resumes one interrupted rollout of the release. The
+// rollouts of a release are saved together, so a rollout is only resumed when
+// no other rollout of the release is running, and the others are resumed on
+// later passes.
+func resumeReleaseRollout(release *types.Release) error {
+	interrupted := []*types.ReleaseRollout{}
+	for _, releaseRollout := range release.Rollouts {
+		switch releaseRollout.Status {
+		case types.RolloutStatusDeploying, types.RolloutStatusWaiting:
+		default:
+			continue
+		}
+		leased, err := redis.GetClient().Exists(releaseRolloutLeaseRedisKey(release, releaseRollout)).Result()
+		if err != nil {
+			return err
+		}
+		if leased {
+			return nil
+		}
+		interrupted = append(interrupted, releaseRollout)
+	}
+
+	for _, releaseRollout := range interrupted {
+		leased, err := acquireReleaseRolloutLease(release, releaseRollout)
+		if err != nil {
+			return err
+		}
+		if !leased {
+			// another replica is resuming the release
+			return nil
+		}
+		if time.Since(releaseRollout.RolloutAt) > releaseRolloutResumeMaxAge {
+			releaseRollout.Status = types.RolloutStatusFailed
+			releaseRollout.Error = fmt.Sprintf("interrupted more than %s after it started", humanizeDuration(releaseRolloutResumeMaxAge))
+			if err := setReleaseValue(release); err != nil {
+				log.WithError(err).Error("failed saving release")
+			}
+			if err := releaseReleaseRolloutLease(release, releaseRollout); err != nil {
+				log.WithError(err).Warn("failed releasing release rollout lease")
+			}
+			continue
+		}
+		log.Infof("resuming release %s rollout %d in %s", release.Name, releaseRollout.ID, releaseRollout.Env)
+		WaitGroup.Add(1)
+		go runReleaseRollout(release, releaseRollout)
+		return nil
+	}
+	return nil
+}
+
+// resumeReleaseTarget reconciles a target of a wave that was interrupted with
+// the cluster. It waits for deployments that already have the target version
+// and for jobs that were already started with it, and deploys the others.
+func resumeReleaseTarget(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
+	switch target.Type {
+	case types.ReleaseTargetTypeApp:
+		liveTarget, err := getLiveReleaseTarget(releaseRollout.Env, target)
+		if err != nil {
+			return "", err
+		}
+		if liveTarget != nil && liveTarget.Tag == target.Tag {
+			return "", waitReleaseDeploymentAvailable(releaseRollout.Env, target.Name)
+		}
+	case types.ReleaseTargetTypeJob:
+		jobName, err := getReleaseJobForTag(releaseRollout, target)
+		if err != nil {
+			return "", err
+		}
+		if jobName != "" {
+			if err := waitReleaseJobComplete(releaseRollout.Env, jobName); err != nil {
+				return "", err
+			}
+			jobRun := &JobRun{
+				Env:     releaseRollout.Env,
+				JobName: target.Name,
+				RunName: jobName,
+			}
+			jobRun.readAttempts()
+			return checkReleaseJobResult(target, jobRun)
+		}
+	}
+	return deployReleaseTarget(target, releaseRollout)
+}
+
+// getReleaseJobForTag returns the name of the most recent job for the target
+// that runs the target version and was started by the release rollout, or an
+// empty string if there is none
+func getReleaseJobForTag(releaseRollout *types.ReleaseRollout, target *types.ReleaseTarget) (string, error) {
+	jobs, err := kube.GetClient(releaseRollout.Env).Jobs().List(metav1.ListOptions{
+		LabelSelector: "job=" + target.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+	// creation timestamps only have second precision
+	rolloutAt := releaseRollout.RolloutAt.Truncate(time.Second)
+	var latestJob *batchv1.Job
+	for ix, job := range jobs.Items {
+		if job.ObjectMeta.CreationTimestamp.Time.Before(rolloutAt) {
+			// runs from before the rollout are not part of it
+			continue
+		}
+		tag, err := getImageTagFromContainers(job.Spec.Template.Spec.Containers)
+		if err != nil || tag != target.Tag {
+			continue
+		}
+		if latestJob == nil || job.ObjectMeta.CreationTimestamp.After(latestJob.ObjectMeta.CreationTimestamp.Time) {
+			latestJob = &jobs.Items[ix]
+		}
+	}
+	if latestJob == nil {
+		return "", nil
+	}
+	return latestJob.ObjectMeta.Name, nil
+}
+
+func waitReleaseDeploymentAvailable(env, name string) error {
+	ticker := time.NewTicker(deploymentPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(config.GetDuration(config.RolloutTimeout))
+	for {
+		deployment, err := kube.GetClient(env).Deployments().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if deployment.Generation <= deployment.Status.ObservedGeneration {
+			replicas := *deployment.Spec.Replicas
+			if deployment.Status.UpdatedReplicas >= replicas && deployment.Status.AvailableReplicas >= replicas {
+				return nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return fmt.Errorf("deployment %s timed out", name)
+		case <-ExitingChan:
+			return errViliExiting
+		}
+	}
+}
+
+func waitReleaseJobComplete(env, name string) error {
+	ticker := time.NewTicker(deploymentPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(config.GetDuration(config.JobRunTimeout))
+	for {
+		job, err := kube.GetClient(env).Jobs().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, condition := range job.Status.Conditions {
+			switch condition.Type {
+			case batchv1.JobComplete:
+				return nil
+			case batchv1.JobFailed:
+				return fmt.Errorf("job %s failed", name)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return fmt.Errorf("job %s timed out", name)
+		case <-ExitingChan:
+			return errViliExiting
+		}
+	}
+}
+
+// leaseOwner identifies this replica as the owner of the release rollout and
+// job run leases it takes
+var leaseOwner = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}()
+
+func acquireReleaseRolloutLease(release *types.Release, releaseRollout *types.ReleaseRollout) (bool, error) {
+	return redis.GetClient().SetNX(
+		releaseRolloutLeaseRedisKey(release, releaseRollout),
+		leaseOwner,
+		releaseRolloutLeaseTTL,
+	).Result()
+}
+
+// renewReleaseRolloutLease extends the lease of the release rollout until the
+// stop channel is closed
+func renewReleaseRolloutLease(release *types.Release, releaseRollout *types.ReleaseRollout, stop <-chan struct{}) {
+	ticker := time.NewTicker(releaseRolloutLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := redis.GetClient().Set(
+				releaseRolloutLeaseRedisKey(release, releaseRollout),
+				leaseOwner,
+				releaseRolloutLeaseTTL,
+			).Err()
+			if err != nil {
+				log.WithError(err).Warn("failed renewing release rollout lease")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func releaseReleaseRolloutLease(release *types.Release, releaseRollout *types.ReleaseRollout) error {
+	key := releaseRolloutLeaseRedisKey(release, releaseRollout)
+	owner, err := redis.GetClient().Get(key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner != leaseOwner {
+		return nil
+	}
+	return redis.GetClient().Del(key).Err()
+}
+
+func releaseRolloutLeaseRedisKey(release *types.Release, releaseRollout *types.ReleaseRollout) string {
+	return fmt.Sprintf("releaserollouts:%s:%s:%d:lease", release.TargetEnv, release.Name, releaseRollout.ID)
+}
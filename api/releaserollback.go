@@ -0,0 +1,148 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/releases"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/slack"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+)
+
+// releaseRollbackHandler reverts the apps of a release to the versions of the
+// release that was deployed to the environment before it. The apps are
+// rolled back wave by wave, in reverse wave order.
+func releaseRollbackHandler(c echo.Context) error {
+	env := c.Param("env")
+	name := c.Param("release")
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+	releaseEnv := environment.DeployedToEnv
+	if releaseEnv == "" {
+		releaseEnv = env
+	}
+	release, err := getReleaseValue(releaseEnv, name)
+	if err != nil {
+		return err
+	}
+	if release.Name == "" {
+		return errors.NotFound("Release not found")
+	}
+
+	deployedAt := lastReleaseDeployment(release, env)
+	if deployedAt == nil {
+		return errors.BadRequest(fmt.Sprintf("Release %s was not deployed to %s", name, env))
+	}
+	releaseList, err := releases.List(releaseEnv)
+	if err != nil {
+		return err
+	}
+	var previousRelease *types.Release
+	var previousDeployedAt *time.Time
+	for _, candidate := range releaseList {
+		if candidate.Name == release.Name {
+			continue
+		}
+		candidateDeployedAt := lastReleaseDeployment(candidate, env)
+		if candidateDeployedAt == nil || !candidateDeployedAt.Before(*deployedAt) {
+			continue
+		}
+		if previousDeployedAt == nil || candidateDeployedAt.After(*previousDeployedAt) {
+			previousRelease = candidate
+			previousDeployedAt = candidateDeployedAt
+		}
+	}
+	if previousRelease == nil {
+		return errors.BadRequest(fmt.Sprintf("No release was deployed to %s before %s", env, name))
+	}
+
+	waves := getReleaseRollbackWaves(release, previousRelease)
+	if len(waves) == 0 {
+		return errors.BadRequest(fmt.Sprintf("Release %s has no apps to roll back to %s", name, previousRelease.Name))
+	}
+
+	username := c.Get("user").(*session.User).Username
+	releaseRollout, err := createReleaseRollout(release, env, username, waves)
+	if err != nil {
+		return err
+	}
+	releaseRollout.Rollback = true
+	releaseRollout.RollbackTo = previousRelease.Name
+	releaseRollout.RollbackWaves = waves
+	if err := setReleaseValue(release); err != nil {
+		return err
+	}
+
+	slackMessage := fmt.Sprintf("release *%s* rollback to *%s* in *%s* started by *%s*",
+		release.Name, previousRelease.Name, env, username)
+	if err := slack.PostLogMessage(slackMessage, log.WarnLevel); err != nil {
+		log.WithError(err).Error("Failed posting slack message")
+	}
+
+	WaitGroup.Add(1)
+	go runReleaseRollout(release, releaseRollout)
+	return c.JSON(http.StatusOK, releaseRollout)
+}
+
+// lastReleaseDeployment returns the time of the last successful rollout of the
+// release to the given environment, not counting rollbacks
+func lastReleaseDeployment(release *types.Release, env string) *time.Time {
+	var deployedAt *time.Time
+	for _, releaseRollout := range release.Rollouts {
+		if releaseRollout.Env != env || releaseRollout.Rollback || releaseRollout.Status != types.RolloutStatusDeployed {
+			continue
+		}
+		if deployedAt == nil || releaseRollout.RolloutAt.After(*deployedAt) {
+			rolloutAt := releaseRollout.RolloutAt
+			deployedAt = &rolloutAt
+		}
+	}
+	return deployedAt
+}
+
+// getReleaseRollbackWaves returns the waves of the release in reverse order,
+// with every app target replaced by the same app from the previous release.
+// Apps that are not in the previous release or that have the same version,
+// as well as jobs and actions, are left out.
+func getReleaseRollbackWaves(release, previousRelease *types.Release) []*types.ReleaseWave {
+	previousTargets := map[string]*types.ReleaseTarget{}
+	for _, wave := range previousRelease.Waves {
+		for _, target := range wave.Targets {
+			if target.Type == types.ReleaseTargetTypeApp {
+				previousTargets[target.Name] = target
+			}
+		}
+	}
+
+	waves := []*types.ReleaseWave{}
+	for ix := len(release.Waves) - 1; ix >= 0; ix-- {
+		wave := &types.ReleaseWave{}
+		for _, target := range release.Waves[ix].Targets {
+			if target.Type != types.ReleaseTargetTypeApp {
+				continue
+			}
+			previousTarget, ok := previousTargets[target.Name]
+			if !ok || (previousTarget.Tag == target.Tag && previousTarget.Branch == target.Branch) {
+				continue
+			}
+			wave.Targets = append(wave.Targets, &types.ReleaseTarget{
+				Type:   types.ReleaseTargetTypeApp,
+				Name:   previousTarget.Name,
+				Branch: previousTarget.Branch,
+				Tag:    previousTarget.Tag,
+			})
+		}
+		if len(wave.Targets) > 0 {
+			waves = append(waves, wave)
+		}
+	}
+	return waves
+}
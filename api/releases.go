@@ -1,11 +1,12 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,9 +15,10 @@ import (
 	"github.com/viliproject/vili/config"
 	"github.com/viliproject/vili/environments"
 	"github.com/viliproject/vili/errors"
-	"github.com/viliproject/vili/firebase"
+	"github.com/viliproject/vili/functions"
 	"github.com/viliproject/vili/kube"
 	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/releases"
 	"github.com/viliproject/vili/repository"
 	"github.com/viliproject/vili/session"
 	"github.com/viliproject/vili/slack"
@@ -25,6 +27,7 @@ import (
 	"github.com/asaskevich/govalidator"
 	"github.com/labstack/echo"
 	corev1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -49,7 +52,8 @@ func releasesGetHandler(c echo.Context) error {
 }
 
 func releasesWatchHandler(ws *websocket.Conn, env string) error {
-	eventsChan := make(chan firebase.Event)
+	eventsChan := make(chan *releases.Event)
+	stop := make(chan struct{})
 	stopped := false
 	var waitGroup sync.WaitGroup
 
@@ -59,24 +63,23 @@ func releasesWatchHandler(ws *websocket.Conn, env string) error {
 		if err == io.EOF {
 			stopped = true
 		}
+		if err != nil {
+			close(stop)
+		}
 	}()
 
 	waitGroup.Add(1)
 	go func() {
 		defer waitGroup.Done()
 		for event := range eventsChan {
-			// Parse event into a release event
-			releaseEvent := getReleaseEvent(event)
-			if releaseEvent != nil {
-				err := websocket.JSON.Send(ws, releaseEvent)
-				if err != nil {
-					log.WithError(err).Warn("error writing to websocket stream")
-				}
+			err := websocket.JSON.Send(ws, event)
+			if err != nil {
+				log.WithError(err).Warn("error writing to websocket stream")
 			}
 		}
 	}()
 
-	err := firebase.Watch(fmt.Sprintf("/releases/%s", env), eventsChan)
+	err := releases.Watch(env, stop, eventsChan)
 	close(eventsChan)
 	waitGroup.Wait()
 	if !stopped {
@@ -85,65 +88,6 @@ func releasesWatchHandler(ws *websocket.Conn, env string) error {
 	return err
 }
 
-// ReleaseEvent represents a change to a release
-type ReleaseEvent struct {
-	Type   string           `json:"type"`
-	Object *types.Release   `json:"object"`
-	List   []*types.Release `json:"list"`
-}
-
-func getReleaseEvent(firebaseEvent firebase.Event) *ReleaseEvent {
-	switch firebaseEvent.Type {
-	case "put":
-		data, _ := json.Marshal(firebaseEvent.Data)
-		if firebaseEvent.Path == "/" {
-			releases := map[string]*types.Release{}
-			err := json.Unmarshal(data, &releases)
-			if err != nil {
-				log.WithError(err).Warn("error parsing releases json")
-				return nil
-			}
-			releaseList := []*types.Release{}
-			for _, release := range releases {
-				if len(release.Rollouts) == 0 {
-					release.Rollouts = []*types.ReleaseRollout{}
-				}
-				releaseList = append(releaseList, release)
-			}
-			return &ReleaseEvent{
-				Type: "INIT",
-				List: releaseList,
-			}
-		}
-		pathSlice := strings.Split(strings.TrimPrefix(firebaseEvent.Path, "/"), "/")
-		if len(pathSlice) != 1 {
-			return nil
-		}
-		if firebaseEvent.Data == nil {
-			return &ReleaseEvent{
-				Type: "DELETED",
-				Object: &types.Release{
-					Name: pathSlice[0],
-				},
-			}
-		}
-		release := &types.Release{
-			Name:     pathSlice[0],
-			Rollouts: []*types.ReleaseRollout{},
-		}
-		err := json.Unmarshal(data, release)
-		if err != nil {
-			log.WithError(err).Warn("error parsing release json")
-			return nil
-		}
-		return &ReleaseEvent{
-			Type:   "MODIFIED",
-			Object: release,
-		}
-	}
-	return nil
-}
-
 func releaseSpecGetHandler(c echo.Context) error {
 	env := c.Param("env")
 
@@ -219,6 +163,11 @@ func releaseCreateHandler(c echo.Context) error {
 		return errors.Conflict("Release already exists")
 	}
 
+	if err := validateRelease(release); err != nil {
+		return err
+	}
+	generateReleaseNotes(release)
+
 	// save release to the database
 	err = setReleaseValue(release)
 	if err != nil {
@@ -229,6 +178,9 @@ func releaseCreateHandler(c echo.Context) error {
 	if release.Link != "" {
 		slackMessage += fmt.Sprintf(" - <%s|release notes>", release.Link)
 	}
+	if notesMessage := releaseNotesSlackMessage(release.Notes); notesMessage != "" {
+		slackMessage += "\n" + notesMessage
+	}
 	err = slack.PostLogMessage(slackMessage, log.InfoLevel)
 	if err != nil {
 		return err
@@ -279,36 +231,71 @@ func releaseDeployHandler(c echo.Context) error {
 	if release.Name == "" {
 		return errors.NotFound("Release not found")
 	}
-	// create release rollout
-	releaseRollout, err := createReleaseRollout(release, env, c.Get("user").(*session.User).Username)
+	releaseRollout, err := startReleaseDeploy(release, env, c.Get("user").(*session.User).Username)
 	if err != nil {
 		return err
 	}
+	return c.JSON(http.StatusOK, releaseRollout)
+}
+
+// startReleaseDeploy creates a rollout of the release to the environment and
+// deploys it in the background
+func startReleaseDeploy(release *types.Release, env, username string) (*types.ReleaseRollout, error) {
+	// create release rollout
+	releaseRollout, err := createReleaseRollout(release, env, username, release.Waves)
+	if err != nil {
+		return nil, err
+	}
 	// deploy release
-	go func() {
-		err = deployRelease(release, releaseRollout)
-		if err != nil {
-			log.WithError(err).Error("failed release rollout")
+	WaitGroup.Add(1)
+	go runReleaseRollout(release, releaseRollout)
+	return releaseRollout, nil
+}
+
+// runReleaseRollout deploys the release rollout while holding its lease, and
+// posts the CI webhook if the release was deployed. If Vili shuts down, the
+// rollout is left in its current state and its lease is released, so that
+// another replica resumes it. Callers add the rollout to the WaitGroup before
+// starting it.
+func runReleaseRollout(release *types.Release, releaseRollout *types.ReleaseRollout) {
+	defer WaitGroup.Done()
+	stopLease := make(chan struct{})
+	go renewReleaseRolloutLease(release, releaseRollout, stopLease)
+	defer func() {
+		close(stopLease)
+		if err := releaseReleaseRolloutLease(release, releaseRollout); err != nil {
+			log.WithError(err).Warn("failed releasing release rollout lease")
 		}
-		if config.GetString(config.CIProvider) != "" {
-			rolloutFailed := false
-			for ix := range release.Waves {
-				releaseRolloutWave := releaseRollout.Waves[ix]
-				if releaseRolloutWave.Status == types.RolloutStatusFailed {
-					rolloutFailed = true
-					log.Errorf("Rollout status: %+v ", releaseRolloutWave.Status)
-					break
-				}
+	}()
+
+	waves := release.Waves
+	if releaseRollout.Rollback {
+		waves = releaseRollout.RollbackWaves
+	}
+	err := deployRelease(release, releaseRollout, waves)
+	if err == errViliExiting {
+		log.Infof("stopped release %s rollout %d in %s for shutdown", release.Name, releaseRollout.ID, releaseRollout.Env)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("failed release rollout")
+	}
+	if config.GetString(config.CIProvider) != "" && !releaseRollout.Rollback {
+		rolloutFailed := false
+		for _, releaseRolloutWave := range releaseRollout.Waves {
+			if releaseRolloutWave.Status == types.RolloutStatusFailed {
+				rolloutFailed = true
+				log.Errorf("Rollout status: %+v ", releaseRolloutWave.Status)
+				break
 			}
-			if !rolloutFailed {
-				err = PostRolloutWebhook(config.GetString(config.CIProvider), env)
-				if err != nil {
-					log.WithError(err).Error("failed to initialize post rollout webhook")
-				}
+		}
+		if !rolloutFailed {
+			err = PostRolloutWebhook(config.GetString(config.CIProvider), releaseRollout.Env)
+			if err != nil {
+				log.WithError(err).Error("failed to initialize post rollout webhook")
 			}
 		}
-	}()
-	return c.JSON(http.StatusOK, releaseRollout)
+	}
 }
 
 func populateReleaseLatestVersions(environment *environments.Environment, release *types.Release) (failed bool) {
@@ -331,9 +318,21 @@ func populateReleaseLatestVersions(environment *environments.Environment, releas
 
 func populateReleaseTargetLatestVersion(environment *environments.Environment, target *types.ReleaseTarget) error {
 	switch target.Type {
-	case types.ReleaseTargetTypeAction:
+	case types.ReleaseTargetTypeAction, types.ReleaseTargetTypeConfigMap:
 		target.Branch = environment.Branch
 		return nil
+	case types.ReleaseTargetTypeFunction:
+		images, err := repository.GetBundleRepository(target.Name, environment.RepositoryBranches)
+		if err != nil {
+			return err
+		}
+		if len(images) == 0 {
+			return fmt.Errorf("Target %s does not have any bundles in the repository", target.Name)
+		}
+		image := images[0]
+		target.Tag = image.Tag
+		target.Branch = image.Branch
+		return nil
 	case types.ReleaseTargetTypeApp, types.ReleaseTargetTypeJob:
 		images, err := repository.GetDockerRepository(target.Name, environment.RepositoryBranches)
 		if err != nil {
@@ -350,7 +349,9 @@ func populateReleaseTargetLatestVersion(environment *environments.Environment, t
 	return nil
 }
 
-func createReleaseRollout(release *types.Release, env, username string) (*types.ReleaseRollout, error) {
+// createReleaseRollout adds a new rollout of the given waves to the release
+// and takes its lease
+func createReleaseRollout(release *types.Release, env, username string, waves []*types.ReleaseWave) (*types.ReleaseRollout, error) {
 	releaseRollout := &types.ReleaseRollout{
 		ID:        len(release.Rollouts) + 1,
 		Env:       env,
@@ -358,9 +359,16 @@ func createReleaseRollout(release *types.Release, env, username string) (*types.
 		RolloutBy: username,
 		Status:    types.RolloutStatusDeploying,
 	}
+	leased, err := acquireReleaseRolloutLease(release, releaseRollout)
+	if err != nil {
+		return nil, err
+	}
+	if !leased {
+		return nil, errors.Conflict("Release rollout already in progress")
+	}
 	release.Rollouts = append(release.Rollouts, releaseRollout)
 	// set status of all waves to "new"
-	for range release.Waves {
+	for range waves {
 		releaseRolloutWave := &types.ReleaseRolloutWave{
 			Status: types.RolloutStatusNew,
 		}
@@ -369,20 +377,61 @@ func createReleaseRollout(release *types.Release, env, username string) (*types.
 	return releaseRollout, setReleaseValue(release)
 }
 
-func deployRelease(release *types.Release, releaseRollout *types.ReleaseRollout) error {
+// deployRelease deploys the given waves, which are either the release waves
+// or the waves of a rollback, and records their status on the release rollout.
+// Waves that finished before the rollout was interrupted are skipped, and the
+// targets of the wave that was deploying are reconciled with the cluster. It
+// returns errViliExiting without changing the rollout if Vili shuts down.
+func deployRelease(release *types.Release, releaseRollout *types.ReleaseRollout, waves []*types.ReleaseWave) error {
+	if len(releaseRollout.Waves) != len(waves) {
+		releaseRollout.Status = types.RolloutStatusFailed
+		releaseRollout.Error = "the release waves changed during the rollout"
+		return setReleaseValue(release)
+	}
 	// deploy each wave in order
-	for ix, wave := range release.Waves {
-		// set status to deploying
+	for ix, wave := range waves {
 		releaseRolloutWave := releaseRollout.Waves[ix]
+		switch releaseRolloutWave.Status {
+		case types.RolloutStatusDeployed, types.RolloutStatusFailed:
+			continue
+		}
+		resume := releaseRolloutWave.Status == types.RolloutStatusDeploying
+		// wait for approval
+		if wave.PauseBefore && !resume {
+			if err := waitReleaseWaveApproval(release, releaseRollout, ix); err != nil {
+				if err == errViliExiting {
+					return err
+				}
+				releaseRollout.Status = types.RolloutStatusFailed
+				releaseRollout.Error = fmt.Sprintf("wave %d: %s", ix+1, err)
+				releaseRolloutWave.Status = types.RolloutStatusFailed
+				releaseRolloutWave.Error = err.Error()
+				return setReleaseValue(release)
+			}
+		}
+		// set status to deploying
+		releaseRollout.Status = types.RolloutStatusDeploying
 		releaseRolloutWave.Status = types.RolloutStatusDeploying
 		if err := setReleaseValue(release); err != nil {
 			return err
 		}
 		// deploy
-		if deployReleaseWave(wave, releaseRollout) {
-			releaseRollout.Status = types.RolloutStatusFailed
+		if err := runReleaseWave(wave, releaseRollout, releaseRolloutWave, resume); err != nil {
+			if err == errViliExiting {
+				return err
+			}
 			releaseRolloutWave.Status = types.RolloutStatusFailed
-			return setReleaseValue(release)
+			releaseRolloutWave.Error = err.Error()
+			if !wave.ContinueOnError {
+				releaseRollout.Status = types.RolloutStatusFailed
+				releaseRollout.Error = fmt.Sprintf("wave %d: %s", ix+1, err)
+				return setReleaseValue(release)
+			}
+			log.WithError(err).Warn("continuing release rollout after failed wave")
+			if err := setReleaseValue(release); err != nil {
+				return err
+			}
+			continue
 		}
 		// set status to deployed
 		releaseRolloutWave.Status = types.RolloutStatusDeployed
@@ -394,36 +443,143 @@ func deployRelease(release *types.Release, releaseRollout *types.ReleaseRollout)
 	return setReleaseValue(release)
 }
 
-func deployReleaseWave(wave *types.ReleaseWave, releaseRollout *types.ReleaseRollout) bool {
+// runReleaseWave deploys the wave, records the results of its targets on the
+// release rollout wave, and returns an error if any of its targets failed, or
+// if the wave did not finish within its timeout. Targets that are still
+// deploying when the wave times out are not stopped, and are recorded with the
+// deploying status. If resume is set, the targets are reconciled with the
+// cluster instead of deployed again.
+func runReleaseWave(wave *types.ReleaseWave, releaseRollout *types.ReleaseRollout, releaseRolloutWave *types.ReleaseRolloutWave, resume bool) error {
+	var timeoutChan <-chan time.Time
+	if wave.Timeout != "" {
+		timeout, err := time.ParseDuration(wave.Timeout)
+		if err != nil {
+			return err
+		}
+		timeoutChan = time.After(timeout)
+	}
+	results := newReleaseWaveResults(wave)
+	done := make(chan struct{})
+	go func() {
+		deployReleaseWave(wave, releaseRollout, results, resume)
+		close(done)
+	}()
+	select {
+	case <-done:
+		releaseRolloutWave.Results = results.list()
+		for _, result := range releaseRolloutWave.Results {
+			if result.Status == types.RolloutStatusFailed {
+				return fmt.Errorf("wave has failed targets")
+			}
+		}
+		return nil
+	case <-timeoutChan:
+		releaseRolloutWave.Results = results.list()
+		return fmt.Errorf("wave timed out after %s", wave.Timeout)
+	case <-ExitingChan:
+		return errViliExiting
+	}
+}
+
+// releaseWaveResults are the results of the targets of a wave, which each
+// target sets when it finishes
+type releaseWaveResults struct {
+	mutex   sync.Mutex
+	results []*types.ReleaseTargetResult
+}
+
+func newReleaseWaveResults(wave *types.ReleaseWave) *releaseWaveResults {
+	results := make([]*types.ReleaseTargetResult, len(wave.Targets))
+	for ix, target := range wave.Targets {
+		results[ix] = &types.ReleaseTargetResult{
+			Type:   target.Type,
+			Name:   target.Name,
+			Status: types.RolloutStatusDeploying,
+		}
+	}
+	return &releaseWaveResults{results: results}
+}
+
+func (r *releaseWaveResults) set(ix int, result *types.ReleaseTargetResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results[ix] = result
+}
+
+// list returns a copy of the results, so that targets that are still
+// deploying do not change them after they are saved
+func (r *releaseWaveResults) list() []*types.ReleaseTargetResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	results := make([]*types.ReleaseTargetResult, len(r.results))
+	for ix, result := range r.results {
+		resultCopy := *result
+		results[ix] = &resultCopy
+	}
+	return results
+}
+
+func deployReleaseWave(wave *types.ReleaseWave, releaseRollout *types.ReleaseRollout, results *releaseWaveResults, resume bool) {
 	log.Debugf("Deploying wave with %d targets", len(wave.Targets))
 	// deploy targets in parallel
 	var wg sync.WaitGroup
-	var failed bool
-	for _, target := range wave.Targets {
+	for ix, target := range wave.Targets {
 		wg.Add(1)
-		go func(target *types.ReleaseTarget) {
+		go func(ix int, target *types.ReleaseTarget) {
 			defer wg.Done()
-			if err := deployReleaseTarget(target, releaseRollout); err != nil {
+			deploy := deployReleaseTarget
+			if resume {
+				deploy = resumeReleaseTarget
+			}
+			message, err := deploy(target, releaseRollout)
+			result := &types.ReleaseTargetResult{
+				Type:    target.Type,
+				Name:    target.Name,
+				Status:  types.RolloutStatusDeployed,
+				Message: message,
+			}
+			if err != nil {
 				log.WithError(err).Error("failed deploying target")
-				failed = true
+				result.Status = types.RolloutStatusFailed
+				result.Error = err.Error()
 			}
-		}(target)
+			results.set(ix, result)
+		}(ix, target)
 	}
 	wg.Wait()
 	log.Debugf("Deployed wave with %d targets", len(wave.Targets))
-	return failed
 }
 
-func deployReleaseTarget(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) error {
+// checkReleaseJobResult returns the summary of the result of the job run, and
+// an error if the result has one of the values the target fails on
+func checkReleaseJobResult(target *types.ReleaseTarget, jobRun *JobRun) (string, error) {
+	keys := []string{}
+	for key := range target.FailOn {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := jobRun.Result[key]
+		if ok && fmt.Sprint(value) == target.FailOn[key] {
+			return jobRun.resultSummary(), fmt.Errorf("job result %s is %s", key, target.FailOn[key])
+		}
+	}
+	return jobRun.resultSummary(), nil
+}
+
+// deployReleaseTarget deploys the target and returns a description of the
+// result for actions
+func deployReleaseTarget(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) (string, error) {
 	switch target.Type {
 	case types.ReleaseTargetTypeAction:
 		log.Debugf(
 			"Executing action %s, from branch %s to env %s, requested by %s",
 			target.Name, target.Branch, releaseRollout.Env, releaseRollout.RolloutBy)
-		switch target.Name {
-		case "syncConfigMaps":
-			return syncConfigMaps(target, releaseRollout)
+		action, ok := releaseActions[target.Name]
+		if !ok {
+			return "", fmt.Errorf("unknown action %s", target.Name)
 		}
+		return action.run(target, releaseRollout)
 	case types.ReleaseTargetTypeApp:
 		log.Debugf(
 			"Rolling out deployment %s, tag %s to env %s, requested by %s",
@@ -435,64 +591,73 @@ func deployReleaseTarget(target *types.ReleaseTarget, releaseRollout *types.Rele
 			Branch:         target.Branch,
 			Tag:            target.Tag,
 		}
-		return rollout.Run(false)
+		return "", rollout.Run(false)
 	case types.ReleaseTargetTypeJob:
 		log.Debugf(
 			"Running job %s, tag %s to env %s, requested by %s",
 			target.Name, target.Tag, releaseRollout.Env, releaseRollout.RolloutBy)
 		jobRun := &JobRun{
-			Env:      releaseRollout.Env,
-			Username: releaseRollout.RolloutBy,
-			JobName:  target.Name,
-			Branch:   target.Branch,
-			Tag:      target.Tag,
+			Env:        releaseRollout.Env,
+			Username:   releaseRollout.RolloutBy,
+			JobName:    target.Name,
+			Branch:     target.Branch,
+			Tag:        target.Tag,
+			Parameters: target.Params,
 		}
-		return jobRun.Run(false)
+		if err := jobRun.Run(false); err != nil {
+			return jobRun.resultSummary(), err
+		}
+		return checkReleaseJobResult(target, jobRun)
+	case types.ReleaseTargetTypeFunction:
+		log.Debugf(
+			"Deploying function %s, tag %s to env %s, requested by %s",
+			target.Name, target.Tag, releaseRollout.Env, releaseRollout.RolloutBy)
+		return "", functions.Deploy(context.Background(), releaseRollout.Env, target.Name, &functions.FunctionDeploySpec{
+			Branch:     target.Branch,
+			Tag:        target.Tag,
+			DeployedBy: releaseRollout.RolloutBy,
+		})
+	case types.ReleaseTargetTypeConfigMap:
+		log.Debugf(
+			"Syncing configmap %s, from branch %s to env %s, requested by %s",
+			target.Name, target.Branch, releaseRollout.Env, releaseRollout.RolloutBy)
+		return "", syncConfigMap(releaseRollout.Env, target.Branch, target.Name)
 	}
-	return nil
+	return "", fmt.Errorf("unknown target type %s", target.Type)
 }
 
-func syncConfigMaps(target *types.ReleaseTarget, releaseRollout *types.ReleaseRollout) error {
-	configmapNames, err := templates.ConfigMaps(releaseRollout.Env, target.Branch)
+// syncConfigMap creates or updates the configmap from its template
+func syncConfigMap(env, branch, name string) error {
+	configmapTemplate, err := templates.ConfigMap(env, branch, name)
 	if err != nil {
 		return err
 	}
-	endpoint := kube.GetClient(releaseRollout.Env).ConfigMaps()
-	for _, configmapName := range configmapNames {
-		configmapTemplate, err := templates.ConfigMap(releaseRollout.Env, target.Branch, configmapName)
-		if err != nil {
-			return err
-		}
-		configmap := new(corev1.ConfigMap)
-		err = configmapTemplate.Parse(configmap)
-		if err != nil {
-			return err
-		}
-		existingConfigMap, err := endpoint.Get(configmapName, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
-		if existingConfigMap == nil {
+	configmap := new(corev1.ConfigMap)
+	err = configmapTemplate.Parse(configmap)
+	if err != nil {
+		return err
+	}
+	endpoint := kube.GetClient(env).ConfigMaps()
+	_, err = endpoint.Get(name, metav1.GetOptions{})
+	if err != nil {
+		if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
 			_, err = endpoint.Create(configmap)
-		} else {
-			_, err = endpoint.Update(configmap)
-		}
-		if err != nil {
 			return err
 		}
+		return err
 	}
-	return nil
+	_, err = endpoint.Update(configmap)
+	return err
 }
 
 func getReleaseValue(env, name string) (*types.Release, error) {
-	release := new(types.Release)
-	return release, firebase.Database().Child("releases").Child(env).Child(name).Value(release)
+	return releases.Get(env, name)
 }
 
 func setReleaseValue(release *types.Release) error {
-	return firebase.Database().Child("releases").Child(release.TargetEnv).Child(release.Name).Set(release)
+	return releases.Set(release)
 }
 
 func deleteRelease(env, name string) error {
-	return firebase.Database().Child("releases").Child(env).Child(name).Remove()
+	return releases.Delete(env, name)
 }
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/slack"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+)
+
+const (
+	// releaseSchedulerInterval is how often the scheduler checks for
+	// scheduled release deploys that are due
+	releaseSchedulerInterval = 15 * time.Second
+	// releaseScheduleMaxDelay is how late a scheduled deploy may fire, for
+	// example after every replica was down, before it is dropped instead
+	releaseScheduleMaxDelay = 15 * time.Minute
+)
+
+// ReleaseSchedule is a deploy of a release to an environment at a future
+// time. ReleaseVersion is a hash of the release when it was scheduled, which
+// is used to refuse the deploy if the release changed since.
+type ReleaseSchedule struct {
+	ID             int       `json:"id"`
+	Env            string    `json:"env"`
+	Release        string    `json:"release"`
+	ReleaseVersion string    `json:"releaseVersion"`
+	DeployAt       time.Time `json:"deployAt"`
+	ScheduledAt    time.Time `json:"scheduledAt"`
+	ScheduledBy    string    `json:"scheduledBy"`
+}
+
+// ReleaseScheduleRequest is the request to schedule a release deploy
+type ReleaseScheduleRequest struct {
+	DeployAt time.Time `json:"deployAt"`
+}
+
+func releaseSchedulesGetHandler(c echo.Context) error {
+	schedules, err := getReleaseSchedules(c.Param("env"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+func releaseScheduleCreateHandler(c echo.Context) error {
+	env := c.Param("env")
+	name := c.Param("release")
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+	releaseEnv := environment.DeployedToEnv
+	if releaseEnv == "" {
+		releaseEnv = env
+	}
+	release, err := getReleaseValue(releaseEnv, name)
+	if err != nil {
+		return err
+	}
+	if release.Name == "" {
+		return errors.NotFound("Release not found")
+	}
+
+	scheduleRequest := new(ReleaseScheduleRequest)
+	if err := json.NewDecoder(c.Request().Body).Decode(scheduleRequest); err != nil {
+		return errors.BadRequest("Invalid body")
+	}
+	if !scheduleRequest.DeployAt.After(time.Now()) {
+		return errors.BadRequest("Deploy time must be in the future")
+	}
+	releaseVersion, err := getReleaseVersion(release)
+	if err != nil {
+		return err
+	}
+	schedule := &ReleaseSchedule{
+		Env:            env,
+		Release:        release.Name,
+		ReleaseVersion: releaseVersion,
+		DeployAt:       scheduleRequest.DeployAt,
+		ScheduledAt:    time.Now(),
+		ScheduledBy:    c.Get("user").(*session.User).Username,
+	}
+	if err := createReleaseSchedule(schedule); err != nil {
+		return err
+	}
+
+	slackMessage := fmt.Sprintf("release *%s* scheduled to deploy to *%s* at %s by *%s*",
+		release.Name, env, schedule.DeployAt.UTC().Format(time.RFC1123), schedule.ScheduledBy)
+	if err := slack.PostLogMessage(slackMessage, log.InfoLevel); err != nil {
+		log.WithError(err).Error("Failed posting slack message")
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+func releaseScheduleDeleteHandler(c echo.Context) error {
+	env := c.Param("env")
+	id := c.Param("schedule")
+	data, err := redis.GetClient().HGet(releaseSchedulesRedisKey(env), id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return errors.NotFound("Release schedule not found")
+		}
+		return err
+	}
+	schedule := new(ReleaseSchedule)
+	if err := json.Unmarshal([]byte(data), schedule); err != nil {
+		return err
+	}
+	deleted, err := redis.GetClient().HDel(releaseSchedulesRedisKey(env), id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errors.NotFound("Release schedule not found")
+	}
+
+	slackMessage := fmt.Sprintf("scheduled deploy of release *%s* to *%s* cancelled by *%s*",
+		schedule.Release, env, c.Get("user").(*session.User).Username)
+	if err := slack.PostLogMessage(slackMessage, log.InfoLevel); err != nil {
+		log.WithError(err).Error("Failed posting slack message")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RunReleaseScheduler deploys scheduled releases when they are due, until the
+// server exits. Every replica runs the scheduler, and each schedule is claimed
+// by removing it from redis, so that only one replica deploys it.
+func RunReleaseScheduler() {
+	ticker := time.NewTicker(releaseSchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, environment := range environments.Environments() {
+				if err := runReleaseSchedules(environment.Name); err != nil {
+					log.WithError(err).Errorf("failed running release schedules for %s", environment.Name)
+				}
+			}
+		case <-ExitingChan:
+			return
+		}
+	}
+}
+
+func runReleaseSchedules(env string) error {
+	schedules, err := getReleaseSchedules(env)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, schedule := range schedules {
+		if schedule.DeployAt.After(now) {
+			continue
+		}
+		claimed, err := redis.GetClient().HDel(releaseSchedulesRedisKey(env), strconv.Itoa(schedule.ID)).Result()
+		if err != nil {
+			return err
+		}
+		if claimed == 0 {
+			// another replica is deploying it, or it was cancelled
+			continue
+		}
+		if err := runReleaseSchedule(schedule, now); err != nil {
+			log.WithError(err).Error("failed running release schedule")
+			slackMessage := fmt.Sprintf("scheduled deploy of release *%s* to *%s* did not run: %s",
+				schedule.Release, env, err)
+			if err := slack.PostLogMessage(slackMessage, log.ErrorLevel); err != nil {
+				log.WithError(err).Error("Failed posting slack message")
+			}
+		}
+	}
+	return nil
+}
+
+func runReleaseSchedule(schedule *ReleaseSchedule, now time.Time) error {
+	if delay := now.Sub(schedule.DeployAt); delay > releaseScheduleMaxDelay {
+		return fmt.Errorf("it is %s past its deploy time", humanizeDuration(delay))
+	}
+	environment, err := environments.Get(schedule.Env)
+	if err != nil {
+		return err
+	}
+	releaseEnv := environment.DeployedToEnv
+	if releaseEnv == "" {
+		releaseEnv = schedule.Env
+	}
+	release, err := getReleaseValue(releaseEnv, schedule.Release)
+	if err != nil {
+		return err
+	}
+	if release.Name == "" {
+		return fmt.Errorf("the release was deleted")
+	}
+	releaseVersion, err := getReleaseVersion(release)
+	if err != nil {
+		return err
+	}
+	if releaseVersion != schedule.ReleaseVersion {
+		return fmt.Errorf("the release was modified after it was scheduled")
+	}
+
+	slackMessage := fmt.Sprintf("release *%s* scheduled by *%s* is deploying to *%s*",
+		release.Name, schedule.ScheduledBy, schedule.Env)
+	if err := slack.PostLogMessage(slackMessage, log.InfoLevel); err != nil {
+		log.WithError(err).Error("Failed posting slack message")
+	}
+	_, err = startReleaseDeploy(release, schedule.Env, schedule.ScheduledBy)
+	return err
+}
+
+// getReleaseVersion returns a hash of the parts of the release that determine
+// what is deployed. Rollouts and notes are not included.
+func getReleaseVersion(release *types.Release) (string, error) {
+	data, err := json.Marshal(struct {
+		Name      string
+		CreatedAt time.Time
+		Waves     []*types.ReleaseWave
+	}{release.Name, release.CreatedAt, release.Waves})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func getReleaseSchedules(env string) ([]*ReleaseSchedule, error) {
+	values, err := redis.GetClient().HGetAllMap(releaseSchedulesRedisKey(env)).Result()
+	if err != nil {
+		return nil, err
+	}
+	schedules := []*ReleaseSchedule{}
+	for _, data := range values {
+		schedule := new(ReleaseSchedule)
+		if err := json.Unmarshal([]byte(data), schedule); err != nil {
+			log.WithError(err).Warn("failed reading release schedule")
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].DeployAt.Before(schedules[j].DeployAt)
+	})
+	return schedules, nil
+}
+
+func createReleaseSchedule(schedule *ReleaseSchedule) error {
+	key := releaseSchedulesRedisKey(schedule.Env)
+	client := redis.GetClient()
+	id, err := client.Incr(key + ":id").Result()
+	if err != nil {
+		return err
+	}
+	schedule.ID = int(id)
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return client.HSet(key, strconv.Itoa(schedule.ID), string(data)).Err()
+}
+
+func releaseSchedulesRedisKey(env string) string {
+	return "releaseschedules:" + env
+}
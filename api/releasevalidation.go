@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/repository"
+	"github.com/viliproject/vili/templates"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+)
+
+// releaseValidateHandler validates a release without creating it
+func releaseValidateHandler(c echo.Context) error {
+	env := c.Param("env")
+	environment, err := environments.Get(env)
+	if err != nil {
+		return err
+	}
+	release := new(types.Release)
+	if err := json.NewDecoder(c.Request().Body).Decode(release); err != nil {
+		return errors.BadRequest("Invalid body")
+	}
+	release.TargetEnv = environment.DeployedToEnv
+	if release.TargetEnv == "" {
+		release.TargetEnv = env
+	}
+	if err := validateRelease(release); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// validateRelease checks every target of the release concurrently against
+// the templates and repositories of the environment it deploys to. It returns
+// a validation error with the problems of each wave and target, keyed by
+// their position such as "waves[0].targets[1]".
+func validateRelease(release *types.Release) error {
+	var mutex sync.Mutex
+	problems := map[string][]string{}
+	addProblem := func(key, problem string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		problems[key] = append(problems[key], problem)
+	}
+
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	for waveIx, wave := range release.Waves {
+		waveKey := fmt.Sprintf("waves[%d]", waveIx)
+		if len(wave.Targets) == 0 {
+			addProblem(waveKey, "wave has no targets")
+		}
+		if wave.Timeout != "" {
+			if _, err := time.ParseDuration(wave.Timeout); err != nil {
+				addProblem(waveKey, fmt.Sprintf("invalid timeout %s", wave.Timeout))
+			}
+		}
+		for targetIx, target := range wave.Targets {
+			targetKey := fmt.Sprintf("%s.targets[%d]", waveKey, targetIx)
+			// jobs and actions may run more than once, for example before
+			// and after a deploy, but an app is only deployed once
+			if target.Type == types.ReleaseTargetTypeApp {
+				if seen[target.Name] {
+					addProblem(targetKey, fmt.Sprintf("app %s is in the release more than once", target.Name))
+				}
+				seen[target.Name] = true
+			}
+			wg.Add(1)
+			go func(targetKey string, target *types.ReleaseTarget) {
+				defer wg.Done()
+				for _, problem := range validateReleaseTarget(release.TargetEnv, target) {
+					addProblem(targetKey, problem)
+				}
+			}(targetKey, target)
+		}
+	}
+	wg.Wait()
+
+	if len(problems) > 0 {
+		return errors.Validation("Invalid release", problems)
+	}
+	return nil
+}
+
+// validateReleaseTarget returns the problems with the target. Errors from the
+// template and repository services are logged and reported as problems, so
+// that they do not hide the problems of other targets.
+func validateReleaseTarget(env string, target *types.ReleaseTarget) []string {
+	if target.Name == "" {
+		return []string{"name is required"}
+	}
+	if len(target.FailOn) > 0 && target.Type != types.ReleaseTargetTypeJob {
+		return []string{"failOn is only supported for jobs"}
+	}
+	switch target.Type {
+	case types.ReleaseTargetTypeAction:
+		if err := validateReleaseAction(target); err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	case types.ReleaseTargetTypeConfigMap:
+		return validateReleaseTargetTemplate(env, target, templates.ConfigMap)
+	case types.ReleaseTargetTypeApp, types.ReleaseTargetTypeJob, types.ReleaseTargetTypeFunction:
+	default:
+		return []string{fmt.Sprintf("unknown target type %s", target.Type)}
+	}
+
+	problems := []string{}
+	if target.Branch == "" {
+		problems = append(problems, "branch is required")
+	}
+	if target.Tag == "" {
+		problems = append(problems, "tag is required")
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	switch target.Type {
+	case types.ReleaseTargetTypeApp:
+		problems = append(problems, validateReleaseTargetTemplate(env, target, templates.Deployment)...)
+	case types.ReleaseTargetTypeJob:
+		problems = append(problems, validateReleaseTargetTemplate(env, target, templates.Job)...)
+		if len(problems) == 0 {
+			problems = append(problems, validateReleaseTargetParameters(env, target)...)
+		}
+	case types.ReleaseTargetTypeFunction:
+		problems = append(problems, validateReleaseTargetTemplate(env, target, templates.Function)...)
+	}
+	if problem := validateReleaseTargetTag(target); problem != "" {
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+func validateReleaseTargetTemplate(env string, target *types.ReleaseTarget, getTemplate func(env, branch, name string) (templates.Template, error)) []string {
+	template, err := getTemplate(env, target.Branch, target.Name)
+	if err != nil {
+		log.WithError(err).Warn("failed getting template to validate release target")
+		return []string{fmt.Sprintf("failed getting the template for %s", target.Name)}
+	}
+	if template == "" {
+		return []string{fmt.Sprintf("%s %s has no template in %s", target.Type, target.Name, env)}
+	}
+	return nil
+}
+
+// validateReleaseTargetParameters checks the params of a job target against
+// the parameters declared by the job template
+func validateReleaseTargetParameters(env string, target *types.ReleaseTarget) []string {
+	template, err := templates.Job(env, target.Branch, target.Name)
+	if err != nil {
+		log.WithError(err).Warn("failed getting template to validate release target")
+		return []string{fmt.Sprintf("failed getting the template for %s", target.Name)}
+	}
+	parameters, err := template.Parameters()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if _, err := templates.ResolveParameters(parameters, target.Params); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// validateReleaseTargetTag checks that the tag exists in the repository and
+// was built from the branch of the target. The tags of function bundles are
+// only checked against the branch, as bundles are not looked up by tag.
+func validateReleaseTargetTag(target *types.ReleaseTarget) string {
+	if target.Type == types.ReleaseTargetTypeFunction {
+		if _, err := repository.BundleFullName(target.Name, target.Tag); err != nil {
+			log.WithError(err).Warn("failed getting bundle to validate release target")
+			return fmt.Sprintf("failed getting the bundle for %s", target.Name)
+		}
+		if !repository.BundleTagMatchesBranch(target.Tag, target.Branch) {
+			return fmt.Sprintf("tag %s was not built from branch %s", target.Tag, target.Branch)
+		}
+		return ""
+	}
+	digest, err := repository.GetDockerTag(target.Name, target.Tag)
+	if err != nil {
+		log.WithError(err).Warn("failed getting tag to validate release target")
+	}
+	if err != nil || digest == "" {
+		return fmt.Sprintf("tag %s not found", target.Tag)
+	}
+	if !repository.DockerTagMatchesBranch(target.Tag, target.Branch) {
+		return fmt.Sprintf("tag %s was not built from branch %s", target.Tag, target.Branch)
+	}
+	return ""
+}
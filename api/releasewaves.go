@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/viliproject/vili/config"
+	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/slack"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+)
+
+// releaseWaveApprovalPollInterval is how often a waiting release rollout
+// checks the release store for an approval, which can be made by any replica
+const releaseWaveApprovalPollInterval = 5 * time.Second
+
+func releaseWaveApproveHandler(c echo.Context) error {
+	rolloutID, err := strconv.Atoi(c.Param("rollout"))
+	if err != nil {
+		return errors.BadRequest("Invalid rollout id")
+	}
+	releaseRollout, err := ApproveReleaseWave(
+		c.Param("env"),
+		c.Param("release"),
+		rolloutID,
+		c.Get("user").(*session.User).Username,
+	)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, releaseRollout)
+}
+
+// ApproveReleaseWave approves the wave that the given rollout of the release
+// is waiting on. If rolloutID is 0, the waiting rollout of the release in the
+// environment is approved.
+func ApproveReleaseWave(env, name string, rolloutID int, username string) (*types.ReleaseRollout, error) {
+	environment, err := environments.Get(env)
+	if err != nil {
+		return nil, err
+	}
+	releaseEnv := environment.DeployedToEnv
+	if releaseEnv == "" {
+		releaseEnv = env
+	}
+	release, err := getReleaseValue(releaseEnv, name)
+	if err != nil {
+		return nil, err
+	}
+	if release.Name == "" {
+		return nil, errors.NotFound("Release not found")
+	}
+
+	var releaseRollout *types.ReleaseRollout
+	for _, candidate := range release.Rollouts {
+		if candidate.Env != env {
+			continue
+		}
+		if candidate.ID == rolloutID || (rolloutID == 0 && candidate.Status == types.RolloutStatusWaiting) {
+			releaseRollout = candidate
+		}
+	}
+	if releaseRollout == nil {
+		return nil, errors.NotFound(fmt.Sprintf("No waiting rollout of release %s in %s", name, env))
+	}
+	if releaseRollout.Status != types.RolloutStatusWaiting {
+		return nil, errors.Conflict("Release rollout is not waiting for approval")
+	}
+	for ix, releaseRolloutWave := range releaseRollout.Waves {
+		if releaseRolloutWave.Status != types.RolloutStatusWaiting {
+			continue
+		}
+		if releaseRolloutWave.ApprovedBy != "" {
+			return nil, errors.Conflict(fmt.Sprintf("Wave %d was already approved by %s", ix+1, releaseRolloutWave.ApprovedBy))
+		}
+		approvedAt := time.Now()
+		releaseRolloutWave.ApprovedBy = username
+		releaseRolloutWave.ApprovedAt = &approvedAt
+		if err := setReleaseValue(release); err != nil {
+			return nil, err
+		}
+		slackMessage := fmt.Sprintf("release *%s* wave %d in *%s* approved by *%s*", name, ix+1, env, username)
+		if err := slack.PostLogMessage(slackMessage, log.InfoLevel); err != nil {
+			log.WithError(err).Error("Failed posting slack message")
+		}
+		return releaseRollout, nil
+	}
+	return nil, errors.Conflict("Release rollout is not waiting for approval")
+}
+
+// waitReleaseWaveApproval marks the wave at the given index as waiting and
+// blocks until it is approved. Approvals are written to the release store by
+// ApproveReleaseWave, so the stored release is polled rather than the one in
+// memory.
+func waitReleaseWaveApproval(release *types.Release, releaseRollout *types.ReleaseRollout, ix int) error {
+	releaseRolloutWave := releaseRollout.Waves[ix]
+	// a resumed rollout may already be waiting
+	if releaseRolloutWave.Status != types.RolloutStatusWaiting {
+		releaseRollout.Status = types.RolloutStatusWaiting
+		releaseRolloutWave.Status = types.RolloutStatusWaiting
+		if err := setReleaseValue(release); err != nil {
+			return err
+		}
+		slackMessage := fmt.Sprintf(
+			"release *%s* rollout in *%s* is waiting for approval to deploy wave %d - approve with `@%s approve %s %s`",
+			release.Name, releaseRollout.Env, ix+1, config.GetString(config.SlackUsername), release.Name, releaseRollout.Env)
+		if err := slack.PostLogMessage(slackMessage, log.WarnLevel); err != nil {
+			log.WithError(err).Error("Failed posting slack message")
+		}
+	}
+
+	ticker := time.NewTicker(releaseWaveApprovalPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			storedRelease, err := getReleaseValue(release.TargetEnv, release.Name)
+			if err != nil {
+				log.WithError(err).Warn("failed checking release wave approval")
+				continue
+			}
+			if storedRelease.Name == "" {
+				return fmt.Errorf("release %s was deleted", release.Name)
+			}
+			for _, storedRollout := range storedRelease.Rollouts {
+				if storedRollout.ID != releaseRollout.ID || ix >= len(storedRollout.Waves) {
+					continue
+				}
+				storedWave := storedRollout.Waves[ix]
+				if storedWave.ApprovedBy != "" {
+					releaseRolloutWave.ApprovedBy = storedWave.ApprovedBy
+					releaseRolloutWave.ApprovedAt = storedWave.ApprovedAt
+					return nil
+				}
+			}
+		case <-ExitingChan:
+			return errViliExiting
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/viliproject/vili/errors"
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/repository"
+	"github.com/viliproject/vili/server"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/types"
+	"github.com/labstack/echo"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RolloutAbort records who aborted a rollout
+type RolloutAbort struct {
+	Username string    `json:"username"`
+	At       time.Time `json:"at"`
+	Rollback bool      `json:"rollback"`
+}
+
+type rolloutAbortRequest struct {
+	Rollback bool `json:"rollback"`
+}
+
+// rolloutAbortHandler stops a rollout that is in progress. The abort is
+// flagged in redis so that the watcher stops wherever it is running, and the
+// deployment is paused or rolled back right away.
+func rolloutAbortHandler(c echo.Context) error {
+	env := c.Param("env")
+	deploymentName := c.Param("deployment")
+
+	id, err := strconv.Atoi(c.Param("rollout"))
+	if err != nil {
+		return server.ErrorResponse(c, errors.BadRequest("Invalid rollout id"))
+	}
+	rollout, err := getRolloutValue(env, deploymentName, id)
+	if err != nil {
+		return err
+	}
+	if rollout == nil {
+		return server.ErrorResponse(c, errors.NotFound("Rollout not found"))
+	}
+	if rollout.State != types.RolloutStatusNew && rollout.State != types.RolloutStatusDeploying {
+		return server.ErrorResponse(c, errors.Conflict(fmt.Sprintf("Rollout is already %s", rollout.State)))
+	}
+
+	abortRequest := new(rolloutAbortRequest)
+	// ignore errors, as the body is optional
+	json.NewDecoder(c.Request().Body).Decode(abortRequest)
+
+	username := c.Get("user").(*session.User).Username
+	set, err := redis.GetClient().HSetNX(
+		rolloutsRedisKey(env, deploymentName)+":aborts", strconv.Itoa(id), username).Result()
+	if err != nil {
+		return err
+	}
+	if !set {
+		return server.ErrorResponse(c, errors.Conflict("Rollout is already being aborted"))
+	}
+
+	rollout.abort(username, abortRequest.Rollback)
+	return c.JSON(http.StatusOK, rollout)
+}
+
+// abort pauses the deployments changed by the rollout, or rolls them back if
+// requested, and records the rollout as aborted
+func (r *Rollout) abort(username string, rollback bool) {
+	r.Abort = &RolloutAbort{
+		Username: username,
+		At:       time.Now(),
+		Rollback: rollback,
+	}
+	r.logMessage(fmt.Sprintf("Rollout aborted by %s", username), log.WarnLevel)
+
+	if err := r.pauseDeployments(rollback); err != nil {
+		r.logMessage(fmt.Sprintf("Failed pausing deployment: %s", err), log.ErrorLevel)
+	}
+	if rollback {
+		if r.FromRevision == "" || (r.Strategy == rolloutStrategyBlueGreen && r.BlueGreen.PreviousColor == "") {
+			r.logMessage("Nothing to roll back to", log.WarnLevel)
+		} else {
+			r.rollback(errRolloutAborted)
+		}
+	}
+	r.finish(errRolloutAborted)
+}
+
+// pauseDeployments pauses the deployments running the new tag. The main
+// deployment is left running if it is going to be rolled back, since paused
+// deployments cannot be rolled back.
+func (r *Rollout) pauseDeployments(rollback bool) error {
+	var names []string
+	switch r.Strategy {
+	case rolloutStrategyCanary:
+		names = append(names, r.canaryName())
+		if !rollback {
+			names = append(names, r.DeploymentName)
+		}
+	case rolloutStrategyBlueGreen:
+		// the service is switched back by the rollback, so the new color can
+		// always be paused
+		names = append(names, blueGreenDeploymentName(r.DeploymentName, r.BlueGreen.Color))
+	default:
+		if !rollback {
+			names = append(names, r.DeploymentName)
+		}
+	}
+
+	imageName, err := repository.DockerFullName(r.DeploymentName, r.Tag)
+	if err != nil {
+		return err
+	}
+	endpoint := kube.GetClient(r.Env).Deployments()
+	for _, name := range names {
+		deployment, err := endpoint.Get(name, metav1.GetOptions{})
+		if err != nil {
+			if statusError, ok := err.(*kubeErrors.StatusError); ok && statusError.Status().Code == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+		containers := deployment.Spec.Template.Spec.Containers
+		if len(containers) == 0 || containers[0].Image != imageName {
+			// the deployment is not running the new tag, e.g. an unpromoted canary
+			continue
+		}
+		deployment.Spec.Paused = true
+		if _, err := endpoint.Update(deployment); err != nil {
+			return err
+		}
+		r.logMessage(fmt.Sprintf("Paused %s", name), log.InfoLevel)
+	}
+	return nil
+}
+
+// checkAborted returns errRolloutAborted if the rollout was aborted
+func (r *Rollout) checkAborted() error {
+	aborted, err := isRolloutAborted(r.Env, r.DeploymentName, r.ID)
+	if err != nil {
+		log.WithError(err).Error("failed checking rollout abort")
+		return nil
+	}
+	if aborted {
+		return errRolloutAborted
+	}
+	return nil
+}
+
+func isRolloutAborted(env, deploymentName string, id int) (bool, error) {
+	return redis.GetClient().HExists(rolloutsRedisKey(env, deploymentName)+":aborts", strconv.Itoa(id)).Result()
+}
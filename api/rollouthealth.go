@@ -0,0 +1,155 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/viliproject/vili/kube"
+	"github.com/viliproject/vili/log"
+	corev1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// crashLoopRestarts is the number of restarts after which a container in
+	// CrashLoopBackOff fails the rollout
+	crashLoopRestarts = 3
+	// podFailureLogLines is the number of log lines attached to a pod failure
+	podFailureLogLines = 20
+)
+
+// waiting reasons of containers that will not recover without a new rollout
+var podFailureWaitingReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+// podFailure is a pod of the new replica set that is not going to become ready
+type podFailure struct {
+	pod       string
+	container string
+	reason    string
+	message   string
+	logs      string
+	// previous is set if the logs are in the previous run of the container
+	previous bool
+}
+
+func (f *podFailure) summary() string {
+	summary := fmt.Sprintf("container %s in pod %s failed with %s", f.container, f.pod, f.reason)
+	if f.message != "" {
+		summary += ": " + f.message
+	}
+	return summary
+}
+
+func (f *podFailure) Error() string {
+	if f.logs == "" {
+		return f.summary()
+	}
+	return fmt.Sprintf("%s\nLast log lines:\n%s", f.summary(), f.logs)
+}
+
+// checkDeploymentHealth returns an error if the deployment exceeded its
+// progress deadline or if a pod of its newest replica set is failing
+func (r *Rollout) checkDeploymentHealth(deployment *extv1beta1.Deployment) error {
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == extv1beta1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return fmt.Errorf("deployment %s exceeded its progress deadline: %s", deployment.Name, condition.Message)
+		}
+	}
+
+	history, err := getRolloutHistoryForDeployment(r.Env, deployment)
+	if err != nil {
+		return err
+	}
+	replicaSet, err := getReplicaSetForDeployment(deployment, history)
+	if err != nil {
+		// the new replica set was not created yet
+		return nil
+	}
+	pods, err := kube.GetClient(r.Env).Pods().List(metav1.ListOptions{
+		LabelSelector: metav1.FormatLabelSelector(replicaSet.Spec.Selector),
+	})
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		if failure := getPodFailure(&pod); failure != nil {
+			failure.logs = r.getPodFailureLogs(failure)
+			return failure
+		}
+	}
+	return nil
+}
+
+// logHealthFailure posts a failed health check, with the logs of the failed
+// pod in a code block
+func (r *Rollout) logHealthFailure(err error) {
+	failure, ok := err.(*podFailure)
+	if !ok {
+		r.logMessage(fmt.Sprintf("Rollout failed, %s", err), log.ErrorLevel)
+		return
+	}
+	message := fmt.Sprintf("Rollout failed, %s", failure.summary())
+	if failure.logs != "" {
+		message += fmt.Sprintf("\n```\n%s\n```", failure.logs)
+	}
+	r.logMessage(message, log.ErrorLevel)
+}
+
+// getPodFailure returns the first container of the pod that is crash looping,
+// was OOM killed or cannot pull its image
+func getPodFailure(pod *corev1.Pod) *podFailure {
+	statuses := append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		failure := &podFailure{
+			pod:       pod.Name,
+			container: status.Name,
+		}
+		if terminated := status.LastTerminationState.Terminated; terminated != nil && terminated.Reason == "OOMKilled" {
+			failure.reason = terminated.Reason
+			failure.previous = true
+			return failure
+		}
+		if terminated := status.State.Terminated; terminated != nil && terminated.Reason == "OOMKilled" {
+			failure.reason = terminated.Reason
+			return failure
+		}
+		waiting := status.State.Waiting
+		if waiting == nil {
+			continue
+		}
+		if podFailureWaitingReasons[waiting.Reason] ||
+			(waiting.Reason == "CrashLoopBackOff" && status.RestartCount >= crashLoopRestarts) {
+			failure.reason = waiting.Reason
+			failure.message = waiting.Message
+			failure.previous = status.RestartCount > 0
+			return failure
+		}
+	}
+	return nil
+}
+
+// getPodFailureLogs returns the last log lines of the failed container, from
+// its previous run if it was restarted
+func (r *Rollout) getPodFailureLogs(failure *podFailure) string {
+	if podFailureWaitingReasons[failure.reason] {
+		// the container never started
+		return ""
+	}
+	tailLines := int64(podFailureLogLines)
+	output, err := kube.GetClient(r.Env).Pods().GetLogs(failure.pod, &corev1.PodLogOptions{
+		Container: failure.container,
+		Previous:  failure.previous,
+		TailLines: &tailLines,
+	}).DoRaw()
+	if err != nil {
+		log.WithError(err).Warn("failed getting logs of failed pod")
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
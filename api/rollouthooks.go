@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/types"
+)
+
+const (
+	rolloutHookPre  = "pre"
+	rolloutHookPost = "post"
+
+	preRolloutJobsAnnotation  = "vili/preRolloutJobs"
+	postRolloutJobsAnnotation = "vili/postRolloutJobs"
+)
+
+// RolloutHook is a job that runs before or after a rollout, with the same
+// branch and tag as the deployment
+type RolloutHook struct {
+	Type    string              `json:"type"`
+	JobName string              `json:"jobName"`
+	RunID   string              `json:"runId,omitempty"`
+	State   types.RolloutStatus `json:"state"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// loadHooks reads the pre- and post-rollout jobs from the comma separated
+// vili/preRolloutJobs and vili/postRolloutJobs deployment template annotations
+func (r *Rollout) loadHooks() error {
+	deployment, err := r.renderDeployment()
+	if err != nil {
+		return err
+	}
+	r.Hooks = nil
+	for _, hookType := range []string{rolloutHookPre, rolloutHookPost} {
+		annotation := preRolloutJobsAnnotation
+		if hookType == rolloutHookPost {
+			annotation = postRolloutJobsAnnotation
+		}
+		for _, jobName := range strings.Split(deployment.ObjectMeta.Annotations[annotation], ",") {
+			jobName = strings.TrimSpace(jobName)
+			if jobName == "" {
+				continue
+			}
+			r.Hooks = append(r.Hooks, &RolloutHook{
+				Type:    hookType,
+				JobName: jobName,
+				State:   types.RolloutStatusNew,
+			})
+		}
+	}
+	return nil
+}
+
+func (r *Rollout) hasHooks(hookType string) bool {
+	for _, hook := range r.Hooks {
+		if hook.Type == hookType {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks runs the jobs of the given hook type one at a time and stops at the
+// first one that fails
+func (r *Rollout) runHooks(hookType string) error {
+	for _, hook := range r.Hooks {
+		if hook.Type != hookType {
+			continue
+		}
+		if err := r.checkAborted(); err != nil {
+			return err
+		}
+		hook.State = types.RolloutStatusDeploying
+		if err := setRolloutValue(r); err != nil {
+			log.WithError(err).Error("failed saving rollout")
+		}
+		r.logMessage(fmt.Sprintf("Running %s-rollout job %s", hookType, hook.JobName), log.InfoLevel)
+
+		jobRun := &JobRun{
+			Env:      r.Env,
+			JobName:  hook.JobName,
+			Branch:   r.Branch,
+			Tag:      r.Tag,
+			Username: r.Username,
+		}
+		err := jobRun.Run(false)
+		hook.RunID = jobRun.ID
+		if err != nil {
+			hook.State = types.RolloutStatusFailed
+			hook.Error = err.Error()
+			return fmt.Errorf("%s-rollout job %s failed: %s", hookType, hook.JobName, err)
+		}
+		hook.State = types.RolloutStatusDeployed
+	}
+	return nil
+}
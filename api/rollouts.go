@@ -4,16 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/viliproject/vili/config"
 	"github.com/viliproject/vili/errors"
 	"github.com/viliproject/vili/kube"
 	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
 	"github.com/viliproject/vili/repository"
 	"github.com/viliproject/vili/server"
 	"github.com/viliproject/vili/session"
 	"github.com/viliproject/vili/templates"
+	"github.com/viliproject/vili/types"
+	"github.com/viliproject/vili/util"
 	"github.com/labstack/echo"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
@@ -39,6 +43,19 @@ func rolloutCreateHandler(c echo.Context) error {
 	rollout.DeploymentName = deploymentName
 	rollout.Username = c.Get("user").(*session.User).Username
 
+	if c.QueryParam("dryRun") != "" {
+		resp, err := rollout.DryRun()
+		if err != nil {
+			switch e := err.(type) {
+			case RolloutInitError:
+				return server.ErrorResponse(c, errors.BadRequest(e.Error()))
+			default:
+				return e
+			}
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+
 	err := rollout.Run(c.Request().URL.Query().Get("async") != "")
 	if err != nil {
 		switch e := err.(type) {
@@ -51,24 +68,156 @@ func rolloutCreateHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, rollout)
 }
 
+// RolloutDryRunResponse is the response to a dry-run rollout request
+type RolloutDryRunResponse struct {
+	Rollout    *Rollout               `json:"rollout"`
+	Deployment *extv1beta1.Deployment `json:"deployment"`
+	Diff       []*DeploymentChange    `json:"diff"`
+}
+
+// RolloutsGetResponse is a response to the get rollouts request
+type RolloutsGetResponse struct {
+	Rollouts []*Rollout `json:"rollouts"`
+	Total    int        `json:"total"`
+}
+
+func rolloutsGetHandler(c echo.Context) error {
+	env := c.Param("env")
+	deploymentName := c.Param("deployment")
+	username := c.QueryParam("user")
+	state := types.RolloutStatus(c.QueryParam("state"))
+
+	rollouts, err := listRolloutValues(env, deploymentName)
+	if err != nil {
+		return err
+	}
+	filtered := []*Rollout{}
+	for _, rollout := range rollouts {
+		if username != "" && rollout.Username != username {
+			continue
+		}
+		if state != "" && rollout.State != state {
+			continue
+		}
+		filtered = append(filtered, rollout)
+	}
+
+	offset, limit := getPaginationFromRequest(c)
+	resp := &RolloutsGetResponse{
+		Rollouts: []*Rollout{},
+		Total:    len(filtered),
+	}
+	if offset < len(filtered) {
+		end := offset + limit
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		resp.Rollouts = filtered[offset:end]
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func rolloutGetHandler(c echo.Context) error {
+	env := c.Param("env")
+	deploymentName := c.Param("deployment")
+
+	id, err := strconv.Atoi(c.Param("rollout"))
+	if err != nil {
+		return server.ErrorResponse(c, errors.BadRequest("Invalid rollout id"))
+	}
+	rollout, err := getRolloutValue(env, deploymentName, id)
+	if err != nil {
+		return err
+	}
+	if rollout == nil {
+		return server.ErrorResponse(c, errors.NotFound("Rollout not found"))
+	}
+	return c.JSON(http.StatusOK, rollout)
+}
+
+// Rollout strategies
+const (
+	rolloutStrategyRolling   = "rolling"
+	rolloutStrategyCanary    = "canary"
+	rolloutStrategyBlueGreen = "bluegreen"
+)
+
 // Rollout represents a single deployment of an image for any app
 // TODO: support MaxUnavailable and MaxSurge for rolling updates
 type Rollout struct {
-	Env            string `json:"env"`
-	DeploymentName string `json:"deploymentName"`
-	Branch         string `json:"branch"`
-	Tag            string `json:"tag"`
-	Username       string `json:"username"`
-	State          string `json:"state"`
-
-	FromDeployment *extv1beta1.Deployment `json:"fromDeployment"`
+	ID             int                 `json:"id"`
+	Env            string              `json:"env"`
+	DeploymentName string              `json:"deploymentName"`
+	Branch         string              `json:"branch"`
+	Tag            string              `json:"tag"`
+	ContainerTags  map[string]string   `json:"containerTags,omitempty"`
+	Digest         string              `json:"digest"`
+	Username       string              `json:"username"`
+	State          types.RolloutStatus `json:"state"`
+	FailureReason  string              `json:"failureReason,omitempty"`
+	StartedAt      time.Time           `json:"startedAt"`
+	EndedAt        *time.Time          `json:"endedAt,omitempty"`
+	Rollback       *RolloutRollback    `json:"rollback,omitempty"`
+	Abort          *RolloutAbort       `json:"abort,omitempty"`
+	Strategy       string              `json:"strategy,omitempty"`
+	Canary         *RolloutCanary      `json:"canary,omitempty"`
+	BlueGreen      *RolloutBlueGreen   `json:"blueGreen,omitempty"`
+	Hooks          []*RolloutHook      `json:"hooks,omitempty"`
+
+	FromDeployment *extv1beta1.Deployment `json:"fromDeployment,omitempty"`
 	FromRevision   string                 `json:"fromRevision"`
-	ToDeployment   *extv1beta1.Deployment `json:"toDeployment"`
+	ToDeployment   *extv1beta1.Deployment `json:"toDeployment,omitempty"`
 	ToRevision     string                 `json:"toRevision"`
 }
 
 // Run initializes a deployment, checks to make sure it is valid, and runs it
 func (r *Rollout) Run(async bool) error {
+	err := r.init()
+	if err != nil {
+		return err
+	}
+
+	err = r.loadHooks()
+	if err != nil {
+		return err
+	}
+
+	r.StartedAt = time.Now()
+	r.State = types.RolloutStatusDeploying
+	err = createRolloutValue(r)
+	if err != nil {
+		return err
+	}
+
+	if async && r.hasHooks(rolloutHookPre) {
+		// pre-rollout jobs can take a while, so run the whole rollout in the background
+		go r.deploy(false)
+		return nil
+	}
+	return r.deploy(async)
+}
+
+// DryRun renders the deployment that the rollout would create and diffs it
+// against the live deployment, without changing anything
+func (r *Rollout) DryRun() (*RolloutDryRunResponse, error) {
+	err := r.init()
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := r.renderDeployment()
+	if err != nil {
+		return nil, err
+	}
+	return &RolloutDryRunResponse{
+		Rollout:    r,
+		Deployment: deployment,
+		Diff:       diffDeployments(r.FromDeployment, deployment),
+	}, nil
+}
+
+// init checks that the tag exists, looks up the live deployment and validates
+// the rollout strategy
+func (r *Rollout) init() error {
 	digest, err := repository.GetDockerTag(r.DeploymentName, r.Tag)
 	if err != nil {
 		return err
@@ -78,6 +227,7 @@ func (r *Rollout) Run(async bool) error {
 			message: fmt.Sprintf("Tag %s not found for deployment %s", r.Tag, r.DeploymentName),
 		}
 	}
+	r.Digest = digest
 
 	fromDeployment, err := kube.GetClient(r.Env).Deployments().Get(r.DeploymentName, metav1.GetOptions{})
 	if err != nil {
@@ -92,28 +242,188 @@ func (r *Rollout) Run(async bool) error {
 		}
 	}
 
-	err = r.createNewDeployment()
+	switch r.Strategy {
+	case "", rolloutStrategyRolling:
+		r.Strategy = rolloutStrategyRolling
+	case rolloutStrategyCanary:
+		if err := r.initCanary(); err != nil {
+			return err
+		}
+	case rolloutStrategyBlueGreen:
+		if err := r.initBlueGreen(); err != nil {
+			return err
+		}
+	default:
+		return RolloutInitError{
+			message: fmt.Sprintf("Invalid rollout strategy %s", r.Strategy),
+		}
+	}
+	return nil
+}
+
+// deploy runs the pre-rollout jobs, creates the deployment for the rollout
+// strategy and waits for it to complete
+func (r *Rollout) deploy(async bool) error {
+	err := r.runHooks(rolloutHookPre)
 	if err != nil {
+		if err != errRolloutAborted {
+			r.logMessage(fmt.Sprintf("Aborted rollout: %s", err), log.ErrorLevel)
+		}
+		r.finish(err)
+		return err
+	}
+
+	var create, complete func() error
+	switch r.Strategy {
+	case rolloutStrategyCanary:
+		create, complete = r.createCanaryDeployment, r.promoteCanary
+	case rolloutStrategyBlueGreen:
+		create, complete = r.createBlueGreenDeployment, r.switchBlueGreen
+	default:
+		create, complete = r.createNewDeployment, r.watch
+	}
+
+	err = create()
+	if err != nil {
+		r.finish(err)
 		return err
 	}
 
 	if async {
-		go r.watchRollout()
+		go complete()
 		return nil
 	}
+	return complete()
+}
 
-	return r.watchRollout()
+// RolloutRollback is an automatic rollback of a failed rollout
+type RolloutRollback struct {
+	ToRevision string    `json:"toRevision"`
+	At         time.Time `json:"at"`
+	Error      string    `json:"error,omitempty"`
 }
 
-func (r *Rollout) createNewDeployment() (err error) {
-	endpoint := kube.GetClient(r.Env).Deployments()
+const autoRollbackAnnotation = "vili/autoRollback"
+
+const deploymentPollInterval = 10 * time.Second
+
+var (
+	errRolloutDeleted = errors.New("deleted")
+	errRolloutTimeout = errors.New("timeout")
+	errRolloutAborted = errors.New("aborted")
+	errViliExiting    = errors.New("vili is shutting down")
+)
+
+// watch waits for the rollout to finish and completes it
+func (r *Rollout) watch() error {
+	return r.complete(r.watchRollout())
+}
+
+// complete runs the post-rollout jobs if the deployment succeeded, rolls the
+// rollout back if it failed and auto-rollback is enabled, and records its
+// final state
+func (r *Rollout) complete(err error) error {
+	if err == nil {
+		err = r.runHooks(rolloutHookPost)
+		if err != nil && !r.autoRollbackEnabled() {
+			r.logMessage(fmt.Sprintf("Rollout finished but %s", err), log.ErrorLevel)
+		}
+	}
+	if err != nil && err != errRolloutAborted && r.autoRollbackEnabled() {
+		r.rollback(err)
+	}
+	r.finish(err)
+	return err
+}
+
+// autoRollbackEnabled returns whether failed rollouts should be rolled back.
+// The deployment annotation takes precedence over the environment setting.
+func (r *Rollout) autoRollbackEnabled() bool {
+	if r.FromDeployment == nil {
+		// nothing to roll back to
+		return false
+	}
+	if r.Strategy == rolloutStrategyBlueGreen && r.BlueGreen.PreviousColor == "" {
+		// the service was not pointing to a color before the rollout
+		return false
+	}
+	if r.ToDeployment != nil {
+		if value, ok := r.ToDeployment.ObjectMeta.Annotations[autoRollbackAnnotation]; ok {
+			if enabled, err := strconv.ParseBool(value); err == nil {
+				return enabled
+			}
+		}
+	}
+	return util.NewStringSet(config.GetStringSlice(config.AutoRollbackEnvs)).Contains(r.Env)
+}
+
+// rollback reverts the deployment to FromRevision, or recreates it from
+// FromDeployment if it was deleted during the rollout
+func (r *Rollout) rollback(rolloutErr error) {
+	r.Rollback = &RolloutRollback{
+		ToRevision: r.FromRevision,
+		At:         time.Now(),
+	}
+	var err error
+	if r.Strategy == rolloutStrategyBlueGreen {
+		// the previous color is still running, so switch the service back to it
+		_, err = switchServiceColor(r.Env, r.DeploymentName, r.BlueGreen.PreviousColor)
+	} else if rolloutErr == errRolloutDeleted {
+		deployment := r.FromDeployment.DeepCopy()
+		deployment.ObjectMeta.ResourceVersion = ""
+		deployment.ObjectMeta.UID = ""
+		deployment.Status = extv1beta1.DeploymentStatus{}
+		_, err = kube.GetClient(r.Env).Deployments().Create(deployment)
+	} else {
+		var revision int64
+		revision, err = strconv.ParseInt(r.FromRevision, 10, 64)
+		if err == nil {
+			err = rollbackDeployment(r.Env, r.DeploymentName, revision)
+		}
+	}
+	if err != nil {
+		r.Rollback.Error = err.Error()
+		r.logMessage(fmt.Sprintf("Failed rolling back to revision %s: %s", r.FromRevision, err), log.ErrorLevel)
+		return
+	}
+	r.logMessage(fmt.Sprintf("Rolled back to revision %s after %s", r.FromRevision, rolloutErr), log.WarnLevel)
+}
+
+// finish sets the final state of the rollout and saves it
+func (r *Rollout) finish(err error) {
+	if err == errRolloutAborted && r.Abort == nil {
+		// the final state was recorded by the abort request
+		return
+	}
+	endedAt := time.Now()
+	r.EndedAt = &endedAt
+	if r.Abort != nil {
+		r.State = types.RolloutStatusAborted
+		r.FailureReason = fmt.Sprintf("aborted by %s", r.Abort.Username)
+	} else if err != nil {
+		r.State = types.RolloutStatusFailed
+		r.FailureReason = err.Error()
+		if r.Rollback != nil && r.Rollback.Error == "" {
+			r.State = types.RolloutStatusRolledBack
+		}
+	} else {
+		r.State = types.RolloutStatusDeployed
+	}
+	if err := setRolloutValue(r); err != nil {
+		log.WithError(err).Error("failed saving rollout")
+	}
+}
+
+// renderDeployment renders the deployment template and sets the labels,
+// annotations, image and replicas for this rollout
+func (r *Rollout) renderDeployment() (deployment *extv1beta1.Deployment, err error) {
 	// get the spec
 	deploymentTemplate, err := templates.Deployment(r.Env, r.Branch, r.DeploymentName)
 	if err != nil {
 		return
 	}
 
-	deployment := new(extv1beta1.Deployment)
+	deployment = new(extv1beta1.Deployment)
 	err = deploymentTemplate.Parse(deployment)
 	if err != nil {
 		return
@@ -143,17 +453,29 @@ func (r *Rollout) createNewDeployment() (err error) {
 		deployment.Spec.Template.ObjectMeta.Annotations["vili/fromRevision"] = r.FromRevision
 	}
 
-	imageName, err := repository.DockerFullName(r.DeploymentName, r.Tag)
+	err = setContainerImages(&deployment.Spec.Template.Spec, deployment.ObjectMeta.Annotations,
+		r.DeploymentName, r.Tag, r.ContainerTags)
 	if err != nil {
+		if e, ok := err.(containerImageError); ok {
+			err = RolloutInitError{message: e.Error()}
+		}
 		return
 	}
-	deployment.Spec.Template.Spec.Containers[0].Image = imageName
 
 	if r.FromDeployment != nil {
 		*deployment.Spec.Replicas = *r.FromDeployment.Spec.Replicas
 	}
 
 	deployment.Spec.Strategy.Type = extv1beta1.RollingUpdateDeploymentStrategyType
+	return
+}
+
+func (r *Rollout) createNewDeployment() (err error) {
+	endpoint := kube.GetClient(r.Env).Deployments()
+	deployment, err := r.renderDeployment()
+	if err != nil {
+		return
+	}
 
 	// create/update deployment
 	r.ToDeployment, err = endpoint.Update(deployment)
@@ -217,6 +539,49 @@ eventLoop:
 	return
 }
 
+// waitDeploymentAvailable polls the named deployment until all of its replicas
+// are updated and available. The check function is called on every poll and
+// stops the wait if it returns an error.
+func (r *Rollout) waitDeploymentAvailable(name string, check func(*extv1beta1.Deployment) error) error {
+	endpoint := kube.GetClient(r.Env).Deployments()
+	ticker := time.NewTicker(deploymentPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(config.GetDuration(config.RolloutTimeout))
+
+	startTime := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.checkAborted(); err != nil {
+				return err
+			}
+			deployment, err := endpoint.Get(name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if err := r.checkDeploymentHealth(deployment); err != nil {
+				return err
+			}
+			if check != nil {
+				if err := check(deployment); err != nil {
+					return err
+				}
+			}
+			if deployment.Generation <= deployment.Status.ObservedGeneration {
+				replicas := *deployment.Spec.Replicas
+				if deployment.Status.UpdatedReplicas >= replicas && deployment.Status.AvailableReplicas >= replicas {
+					return nil
+				}
+			}
+		case <-timeout:
+			elapsed := time.Now().Sub(startTime)
+			return fmt.Errorf("deployment %s timed out after %s", name, humanizeDuration(elapsed))
+		case <-ExitingChan:
+			return errViliExiting
+		}
+	}
+}
+
 func (r *Rollout) watchRollout() (err error) {
 	watcher, err := kube.GetClient(r.Env).Deployments().Watch(metav1.ListOptions{
 		FieldSelector: "metadata.name=" + r.DeploymentName,
@@ -225,10 +590,29 @@ func (r *Rollout) watchRollout() (err error) {
 		return err
 	}
 
+	ticker := time.NewTicker(deploymentPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(config.GetDuration(config.RolloutTimeout))
+
 	startTime := time.Now()
 eventLoop:
 	for {
 		select {
+		case <-ticker.C:
+			if err = r.checkAborted(); err != nil {
+				watcher.Stop()
+				break eventLoop
+			}
+			deployment, getErr := kube.GetClient(r.Env).Deployments().Get(r.DeploymentName, metav1.GetOptions{})
+			if getErr != nil {
+				// the watcher reports deleted deployments
+				continue
+			}
+			if err = r.checkDeploymentHealth(deployment); err != nil {
+				r.logHealthFailure(err)
+				watcher.Stop()
+				break eventLoop
+			}
 		case event, ok := <-watcher.ResultChan():
 			if !ok {
 				break eventLoop
@@ -239,7 +623,7 @@ eventLoop:
 			case watch.Deleted:
 				r.logMessage(fmt.Sprintf("Deleted deployment after %s", humanizeDuration(elapsed)), log.WarnLevel)
 				watcher.Stop()
-				err = fmt.Errorf("deleted")
+				err = errRolloutDeleted
 				break eventLoop
 			case watch.Added, watch.Modified:
 				if deployment.Generation <= deployment.Status.ObservedGeneration {
@@ -251,11 +635,11 @@ eventLoop:
 					}
 				}
 			}
-		case <-time.After(config.GetDuration(config.RolloutTimeout)):
+		case <-timeout:
 			elapsed := time.Now().Sub(startTime)
 			r.logMessage(fmt.Sprintf("Deployment timed out after %s", humanizeDuration(elapsed)), log.WarnLevel)
 			watcher.Stop()
-			err = fmt.Errorf("timeout")
+			err = errRolloutTimeout
 			break eventLoop
 		}
 	}
@@ -296,3 +680,105 @@ type RolloutInitError struct {
 func (e RolloutInitError) Error() string {
 	return e.message
 }
+
+func rolloutsRedisKey(env, deploymentName string) string {
+	return fmt.Sprintf("rollouts:%s:%s", env, deploymentName)
+}
+
+// createRolloutValue assigns a new id to the rollout, saves it and trims the
+// rollout history for the deployment to the configured size
+func createRolloutValue(r *Rollout) error {
+	key := rolloutsRedisKey(r.Env, r.DeploymentName)
+	client := redis.GetClient()
+	id, err := client.Incr(key + ":id").Result()
+	if err != nil {
+		return err
+	}
+	r.ID = int(id)
+	if err := setRolloutValue(r); err != nil {
+		return err
+	}
+	if err := client.LPush(key+":ids", strconv.Itoa(r.ID)).Err(); err != nil {
+		return err
+	}
+
+	historySize := int64(config.GetInt(config.RolloutHistorySize))
+	expiredIDs, err := client.LRange(key+":ids", historySize, -1).Result()
+	if err != nil {
+		return err
+	}
+	if len(expiredIDs) > 0 {
+		if err := client.HDel(key, expiredIDs...).Err(); err != nil {
+			return err
+		}
+		if err := client.HDel(key+":aborts", expiredIDs...).Err(); err != nil {
+			return err
+		}
+	}
+	return client.LTrim(key+":ids", 0, historySize-1).Err()
+}
+
+func setRolloutValue(r *Rollout) error {
+	if r.Abort == nil {
+		// do not overwrite the state recorded by an abort request
+		aborted, err := isRolloutAborted(r.Env, r.DeploymentName, r.ID)
+		if err != nil {
+			return err
+		}
+		if aborted {
+			return nil
+		}
+	}
+	// the deployment objects are not stored with the rollout history
+	record := *r
+	record.FromDeployment = nil
+	record.ToDeployment = nil
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return redis.GetClient().HSet(rolloutsRedisKey(r.Env, r.DeploymentName), strconv.Itoa(r.ID), string(data)).Err()
+}
+
+func getRolloutValue(env, deploymentName string, id int) (*Rollout, error) {
+	data, err := redis.GetClient().HGet(rolloutsRedisKey(env, deploymentName), strconv.Itoa(id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rollout := new(Rollout)
+	return rollout, json.Unmarshal([]byte(data), rollout)
+}
+
+// listRolloutValues returns the rollout history for the deployment, newest first
+func listRolloutValues(env, deploymentName string) ([]*Rollout, error) {
+	key := rolloutsRedisKey(env, deploymentName)
+	client := redis.GetClient()
+	ids, err := client.LRange(key+":ids", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	rollouts := []*Rollout{}
+	if len(ids) == 0 {
+		return rollouts, nil
+	}
+	values, err := client.HMGet(key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		rollout := new(Rollout)
+		if err := json.Unmarshal([]byte(data), rollout); err != nil {
+			log.WithError(err).Warn("error parsing rollout json")
+			continue
+		}
+		rollouts = append(rollouts, rollout)
+	}
+	return rollouts, nil
+}
@@ -3,18 +3,25 @@ package api
 import (
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/viliproject/vili/log"
 	"github.com/labstack/echo"
 	"golang.org/x/net/websocket"
+	corev1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
 var (
 	webSocketCloseMessage = map[string]string{
 		"type": "CLOSED",
@@ -40,6 +47,23 @@ func getListOptionsFromRequest(c echo.Context) metav1.ListOptions {
 	}
 }
 
+// getPaginationFromRequest returns the offset and limit query parameters,
+// falling back to the defaults if they are missing or invalid
+func getPaginationFromRequest(c echo.Context) (offset, limit int) {
+	offset, err := strconv.Atoi(c.QueryParam("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err = strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return
+}
+
 func getListOptionsForDeployment(deployment *extv1beta1.Deployment) metav1.ListOptions {
 	var selector []string
 	for k, v := range deployment.Spec.Selector.MatchLabels {
@@ -63,9 +87,12 @@ func getPortFromDeployment(deployment *extv1beta1.Deployment) (int32, error) {
 }
 
 func getImageTagFromDeployment(deployment *extv1beta1.Deployment) (string, error) {
-	containers := deployment.Spec.Template.Spec.Containers
+	return getImageTagFromContainers(deployment.Spec.Template.Spec.Containers)
+}
+
+func getImageTagFromContainers(containers []corev1.Container) (string, error) {
 	if len(containers) == 0 {
-		return "", fmt.Errorf("no containers in deployment")
+		return "", fmt.Errorf("no containers in pod spec")
 	}
 	image := containers[0].Image
 	imageSplit := strings.Split(image, ":")
@@ -9,9 +9,12 @@ import (
 
 	"github.com/viliproject/vili/api"
 	"github.com/viliproject/vili/environments"
+	"github.com/viliproject/vili/errors"
 	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/rbac"
 	"github.com/viliproject/vili/redis"
 	"github.com/viliproject/vili/repository"
+	"github.com/viliproject/vili/session"
 	"github.com/viliproject/vili/slack"
 	"github.com/viliproject/vili/util"
 )
@@ -131,6 +134,12 @@ func handleCommand(command []string, username string) error {
 			}
 		}
 		rolloutDeployment(env, deployment, tag, branch, username)
+	case "approve":
+		if len(command) != 3 {
+			log.Debugf("Skipping invalid command %s", command)
+			return nil
+		}
+		approveReleaseWave(command[2], command[1], username)
 	default:
 		// TODO print usage?
 		log.Debugf("Ignoring unknown command", command[0])
@@ -161,7 +170,37 @@ func handlePublish(images []string, tag, branch, username string) error {
 	return nil
 }
 
+func approveReleaseWave(env, release, username string) {
+	if !slackUserCan(username, env, rbac.ActionReleaseDeploy) {
+		return
+	}
+	log.Debugf("Approving release %s in env %s, requested by %s", release, env, username)
+	_, err := api.ApproveReleaseWave(env, release, 0, username)
+	if err != nil {
+		switch e := err.(type) {
+		case *errors.ErrorResponse:
+			slack.PostLogMessage(e.Message, log.ErrorLevel)
+		default:
+			log.Error(e)
+		}
+	}
+}
+
+// slackUserCan returns whether the slack user is allowed to perform the action
+// in the env. Slack users are matched to the access policy by username, so
+// bindings for groups do not apply to them.
+func slackUserCan(username, env string, action rbac.Action) bool {
+	if rbac.Can(&session.User{Username: username}, env, action) {
+		return true
+	}
+	slack.PostLogMessage(fmt.Sprintf("*%s* is not allowed to %s in *%s*", username, action, env), log.ErrorLevel)
+	return false
+}
+
 func rolloutDeployment(env, deployment, tag, branch, username string) {
+	if !slackUserCan(username, env, rbac.ActionRollout) {
+		return
+	}
 	log.Debugf("Rolling out deployment %s, tag %s to env %s, requested by %s", deployment, tag, env, username)
 	rollout := &api.Rollout{
 		Env:            env,
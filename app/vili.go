@@ -16,7 +16,9 @@ import (
 	"github.com/viliproject/vili/log"
 	"github.com/viliproject/vili/middleware"
 	"github.com/viliproject/vili/public"
+	"github.com/viliproject/vili/rbac"
 	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/releases"
 	"github.com/viliproject/vili/repository"
 	"github.com/viliproject/vili/server"
 	"github.com/viliproject/vili/session"
@@ -82,15 +84,30 @@ func New() *App {
 			}
 		},
 
-		// set up the firebase client
+		// set up the release store
 		func() {
 			defer wg.Done()
-			err := firebase.Init(&firebase.Config{
-				URL:    config.GetString(config.FirebaseURL),
-				Secret: config.GetString(config.FirebaseSecret),
-			})
-			if err != nil {
-				log.Fatal(err)
+			switch config.GetString(config.ReleaseStore) {
+			case "firebase":
+				err := firebase.Init(&firebase.Config{
+					URL:    config.GetString(config.FirebaseURL),
+					Secret: config.GetString(config.FirebaseSecret),
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
+				releases.InitFirebase()
+			case "redis":
+				releases.InitRedis()
+			case "disk":
+				err := releases.InitDisk(&releases.DiskConfig{
+					Dir: config.GetString(config.ReleaseStoreDir),
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
+			default:
+				log.Fatal("invalid release store provided")
 			}
 		},
 
@@ -222,6 +239,17 @@ func New() *App {
 			})
 		},
 
+		// set up role based access control
+		func() {
+			defer wg.Done()
+			err := rbac.Init(&rbac.Config{
+				Policy: config.GetString(config.RBACPolicy),
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+
 		// set up the auth service
 		func() {
 			defer wg.Done()
@@ -305,6 +333,10 @@ func New() *App {
 // Start starts the app
 func (a *App) Start() {
 	go runDeployBot()
+	go api.RunReleaseScheduler()
+	go api.ResumeReleaseRollouts()
+	go api.RunBlueGreenScaleDowns()
+	go api.ResumeJobRuns()
 	go environments.WatchEnvs()
 	a.server.Start()
 }
@@ -325,13 +357,14 @@ func healthCheck() error {
 
 func shutdown() {
 	auth.Cleanup()
-	log.Info("waiting for deployments and slack bot")
+	log.Info("waiting for deployments, release rollouts and slack bot")
 	close(environments.ExitingChan)
 	close(api.ExitingChan)
 	close(kube.ExitingChan)
 	close(slack.ExitingChan)
 	close(firebase.ExitingChan)
+	close(releases.ExitingChan)
 	api.WaitGroup.Wait()
 	slack.WaitGroup.Wait()
-	log.Info("finished with deployments and slack bot")
+	log.Info("finished with deployments, release rollouts and slack bot")
 }
@@ -27,11 +27,13 @@ const (
 	SAMLMetadataURL         = "saml-metadata-url"
 	BasicAuthUsers          = "basic-auth-users"
 	HardcodedTokenUsers     = "hardcoded-token-users"
+	RBACPolicy              = "rbac-policy"
 	GithubToken             = "github-token"
 	GithubOwner             = "github-owner"
 	GithubRepo              = "github-repo"
 	GithubDefaultBranch     = "github-default-branch"
 	GithubContentsPath      = "github-contents-path"
+	GithubTargetRepos       = "github-target-repos"
 	DockerMode              = "docker-mode"
 	BundleMode              = "bundle-mode"
 	FunctionsMode           = "functions-mode"
@@ -46,6 +48,8 @@ const (
 	RegistryPassword        = "registry-password"
 	BundleNamespace         = "bundle-namespace"
 	ECRAccountID            = "ecr-account-id"
+	ReleaseStore            = "release-store"
+	ReleaseStoreDir         = "release-store-dir"
 	FirebaseURL             = "firebase-url"
 	FirebaseSecret          = "firebase-secret"
 	SlackToken              = "slack-token"
@@ -55,6 +59,11 @@ const (
 	SlackDeployUsernames    = "slack-deploy-usernames"
 	RolloutTimeout          = "rollout-timeout"
 	JobRunTimeout           = "job-run-timeout"
+	RolloutHistorySize      = "rollout-history-size"
+	JobRunHistorySize       = "job-run-history-size"
+	AutoRollbackEnvs        = "auto-rollback-envs"
+	CanaryBakeTime          = "canary-bake-time"
+	BlueGreenKeepTime       = "blue-green-keep-time"
 	CIProvider              = "ci-provider"
 	CircleCIToken           = "circleci-token"
 )
@@ -84,8 +93,13 @@ func InitApp() error {
 	SetDefault(ApprovalProdEnvs, "preprod prod")
 	SetDefault(RegistryBranchDelimiter, "-")
 	SetDefault(DockerMode, "registry")
+	SetDefault(ReleaseStore, "firebase")
 	SetDefault(RolloutTimeout, 10*time.Minute)
 	SetDefault(JobRunTimeout, 10*time.Minute)
+	SetDefault(RolloutHistorySize, 100)
+	SetDefault(JobRunHistorySize, 100)
+	SetDefault(CanaryBakeTime, 5*time.Minute)
+	SetDefault(BlueGreenKeepTime, 30*time.Minute)
 	return Require(
 		BuildDir,
 		URI,
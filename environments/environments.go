@@ -35,6 +35,7 @@ type Environment struct {
 	DeployedToEnv      string   `json:"deployedToEnv,omitempty"`
 	ApprovedFromEnv    string   `json:"approvedFromEnv,omitempty"`
 	Jobs               []string `json:"jobs"`
+	CronJobs           []string `json:"cronJobs"`
 	Deployments        []string `json:"deployments"`
 	Functions          []string `json:"functions"`
 	ConfigMaps         []string `json:"configmaps"`
@@ -67,6 +68,11 @@ func (e *Environment) fillSpecs() {
 		log.Error(err)
 		return
 	}
+	cronJobs, err := templates.CronJobs(e.Name, e.Branch)
+	if err != nil {
+		log.Error(err)
+		return
+	}
 	deployments, err := templates.Deployments(e.Name, e.Branch)
 	if err != nil {
 		log.Error(err)
@@ -83,6 +89,7 @@ func (e *Environment) fillSpecs() {
 		return
 	}
 	e.Jobs = jobs
+	e.CronJobs = cronJobs
 	e.Deployments = deployments
 	e.Functions = functions
 	e.ConfigMaps = configMaps
@@ -36,8 +36,10 @@ func Database() *firego.Firebase {
 	return database
 }
 
-// Watch listens for changes on the given path and sends the events to the given chan
-func Watch(path string, eventsChan chan Event) error {
+// Watch listens for changes on the given path and sends the events to the
+// given chan until stop is closed. The events chan is not written to after
+// Watch returns.
+func Watch(path string, eventsChan chan Event, stop <-chan struct{}) error {
 	url := strings.TrimSuffix(config.URL, "/") + path
 	log.WithField("url", url).Debug("listening to firebase path")
 	db := firego.New(url)
@@ -48,23 +50,48 @@ func Watch(path string, eventsChan chan Event) error {
 		return err
 	}
 
-	watchChan := make(chan struct{})
+	// the events are forwarded until c is closed or done is closed, and
+	// forwarded is closed once no more events are sent to eventsChan
+	done := make(chan struct{})
+	forwarded := make(chan struct{})
 	go func() {
-		for event := range c {
-			eventsChan <- Event(event)
+		defer close(forwarded)
+		for {
+			select {
+			case event, ok := <-c:
+				if !ok {
+					return
+				}
+				select {
+				case eventsChan <- Event(event):
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
 		}
-		close(watchChan)
 	}()
 
-	// wait until close is called on either watchChan or ExitingChan
+	// wait until close is called on either forwarded, stop or ExitingChan
 	select {
-	case <-watchChan:
+	case <-forwarded:
+		break
+	case <-stop:
 		break
 	case <-ExitingChan:
 		break
 	}
+	close(done)
+	<-forwarded
 
-	db.StopWatching()
+	// firego may block while it stops watching and until its events are
+	// read, so it is stopped and c is drained without waiting for either
+	go db.StopWatching()
+	go func() {
+		for range c {
+		}
+	}()
 	return nil
 }
 
@@ -1,5 +1,11 @@
 package git
 
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
 var service Service
 
 // Service is a git service that allows for querying and retrieving content
@@ -8,6 +14,18 @@ type Service interface {
 	Branches() ([]string, error)
 	Contents(branch, path string) (string, error)
 	List(branch, path string) ([]string, error)
+	Commits(repo, base, head string) ([]*Commit, error)
+}
+
+// Commit is a commit in a repository. If the commit merged a pull request,
+// the number and title of the pull request are set.
+type Commit struct {
+	SHA              string `json:"sha"`
+	Message          string `json:"message"`
+	Author           string `json:"author"`
+	URL              string `json:"url,omitempty"`
+	PullRequest      int    `json:"pullRequest,omitempty"`
+	PullRequestTitle string `json:"pullRequestTitle,omitempty"`
 }
 
 // Branches returns a list of branches for the repository
@@ -24,3 +42,40 @@ func Contents(branch, path string) (string, error) {
 func List(branch, path string) ([]string, error) {
 	return service.List(branch, path)
 }
+
+// Commits returns the commits after base up to and including head, oldest
+// first. An empty repo refers to the configured repository.
+func Commits(repo, base, head string) ([]*Commit, error) {
+	return service.Commits(repo, base, head)
+}
+
+var (
+	mergeCommitRegexp  = regexp.MustCompile(`^Merge pull request #(\d+) from \S+`)
+	squashCommitRegexp = regexp.MustCompile(`^(.*) \(#(\d+)\)$`)
+)
+
+// NewCommit returns a commit with the first line of the message, and the pull
+// request parsed from GitHub merge and squash commit messages
+func NewCommit(sha, message, author, url string) *Commit {
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	commit := &Commit{
+		SHA:     sha,
+		Message: strings.TrimSpace(lines[0]),
+		Author:  author,
+		URL:     url,
+	}
+	if match := mergeCommitRegexp.FindStringSubmatch(commit.Message); match != nil {
+		commit.PullRequest, _ = strconv.Atoi(match[1])
+		// the pull request title is the first non-empty line after the subject
+		for _, line := range lines[1:] {
+			if line = strings.TrimSpace(line); line != "" {
+				commit.PullRequestTitle = line
+				break
+			}
+		}
+	} else if match := squashCommitRegexp.FindStringSubmatch(commit.Message); match != nil {
+		commit.PullRequest, _ = strconv.Atoi(match[2])
+		commit.PullRequestTitle = match[1]
+	}
+	return commit
+}
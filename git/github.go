@@ -102,3 +102,34 @@ func (s *githubService) List(branch, path string) ([]string, error) {
 	}
 	return paths, nil
 }
+
+// Commits returns the commits after base up to and including head, oldest first
+func (s *githubService) Commits(repo, base, head string) ([]*Commit, error) {
+	if repo == "" {
+		repo = s.config.Repo
+	}
+	comparison, _, err := s.client.Repositories.CompareCommits(context.TODO(), s.config.Owner, repo, base, head)
+	if err != nil {
+		return nil, err
+	}
+	commits := []*Commit{}
+	for _, repositoryCommit := range comparison.Commits {
+		var message, author string
+		if repositoryCommit.Commit != nil {
+			message = repositoryCommit.Commit.GetMessage()
+			if repositoryCommit.Commit.Author != nil {
+				author = repositoryCommit.Commit.Author.GetName()
+			}
+		}
+		if repositoryCommit.Author != nil && repositoryCommit.Author.GetLogin() != "" {
+			author = repositoryCommit.Author.GetLogin()
+		}
+		commits = append(commits, NewCommit(
+			repositoryCommit.GetSHA(),
+			message,
+			author,
+			repositoryCommit.GetHTMLURL(),
+		))
+	}
+	return commits, nil
+}
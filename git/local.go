@@ -0,0 +1,114 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LocalRepo is an in-memory repository for the local git service
+type LocalRepo struct {
+	// Files maps branch names to file paths to file contents
+	Files map[string]map[string]string
+	// Commits are the commits of the repository, oldest first
+	Commits []*Commit
+}
+
+// LocalConfig is the configuration for the local git service
+type LocalConfig struct {
+	DefaultBranch string
+	// Repos maps repository names to repositories. The repository with an
+	// empty name is the configured repository.
+	Repos map[string]*LocalRepo
+}
+
+type localService struct {
+	config *LocalConfig
+}
+
+// InitLocal initializes a git service that serves branches, files and commits
+// from memory instead of GitHub, for tests and local development
+func InitLocal(config *LocalConfig) {
+	service = &localService{
+		config: config,
+	}
+}
+
+func (s *localService) repo(name string) (*LocalRepo, error) {
+	repo, ok := s.config.Repos[name]
+	if !ok {
+		return nil, fmt.Errorf("repository %s not found", name)
+	}
+	return repo, nil
+}
+
+// Branches returns a list of branches for the repository
+func (s *localService) Branches() ([]string, error) {
+	repo, err := s.repo("")
+	if err != nil {
+		return nil, err
+	}
+	branches := []string{}
+	for branch := range repo.Files {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+// Contents returns the contents of the file at the given path
+func (s *localService) Contents(branch, path string) (string, error) {
+	repo, err := s.repo("")
+	if err != nil {
+		return "", err
+	}
+	if branch == "" {
+		branch = s.config.DefaultBranch
+	}
+	return repo.Files[branch][path], nil
+}
+
+// List returns a list of subpaths of the given directory path
+func (s *localService) List(branch, path string) ([]string, error) {
+	repo, err := s.repo("")
+	if err != nil {
+		return nil, err
+	}
+	if branch == "" {
+		branch = s.config.DefaultBranch
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	paths := []string{}
+	for filePath := range repo.Files[branch] {
+		if strings.HasPrefix(filePath, prefix) {
+			paths = append(paths, strings.TrimPrefix(filePath, prefix))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Commits returns the commits after base up to and including head, oldest first
+func (s *localService) Commits(repoName, base, head string) ([]*Commit, error) {
+	repo, err := s.repo(repoName)
+	if err != nil {
+		return nil, err
+	}
+	baseIndex, headIndex := -1, -1
+	for ix, commit := range repo.Commits {
+		switch commit.SHA {
+		case base:
+			baseIndex = ix
+		case head:
+			headIndex = ix
+		}
+	}
+	if baseIndex == -1 || headIndex == -1 {
+		return nil, fmt.Errorf("commits %s and %s not found", base, head)
+	}
+	commits := []*Commit{}
+	for ix := baseIndex + 1; ix <= headIndex; ix++ {
+		commits = append(commits, repo.Commits[ix])
+	}
+	return commits, nil
+}
@@ -0,0 +1,40 @@
+package git_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/viliproject/vili/git"
+)
+
+func TestLocalCommits(t *testing.T) {
+	git.InitLocal(&git.LocalConfig{
+		Repos: map[string]*git.LocalRepo{
+			"": &git.LocalRepo{
+				Commits: []*git.Commit{
+					git.NewCommit("a", "Initial commit", "someone", ""),
+					git.NewCommit("b", "Merge pull request #12 from org/feature\n\nAdd a feature", "someone", ""),
+					git.NewCommit("c", "Fix a bug (#13)\n\n* details", "someone else", ""),
+					git.NewCommit("d", "Unreleased change", "someone", ""),
+				},
+			},
+		},
+	})
+
+	commits, err := git.Commits("", "a", "c")
+	assert.NoError(t, err)
+	if assert.Len(t, commits, 2) {
+		assert.Equal(t, "b", commits[0].SHA)
+		assert.Equal(t, 12, commits[0].PullRequest)
+		assert.Equal(t, "Add a feature", commits[0].PullRequestTitle)
+		assert.Equal(t, "Fix a bug (#13)", commits[1].Message)
+		assert.Equal(t, 13, commits[1].PullRequest)
+		assert.Equal(t, "Fix a bug", commits[1].PullRequestTitle)
+	}
+
+	_, err = git.Commits("", "a", "missing")
+	assert.Error(t, err)
+	_, err = git.Commits("other", "a", "b")
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package kube
 
 import (
 	batchv1 "k8s.io/client-go/kubernetes/typed/batch/v1"
+	batchv1beta1 "k8s.io/client-go/kubernetes/typed/batch/v1beta1"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	extensionsv1beta1 "k8s.io/client-go/kubernetes/typed/extensions/v1beta1"
 )
@@ -36,6 +37,11 @@ func (k *Client) Jobs() batchv1.JobInterface {
 	return k.Batch().Jobs(k.namespace)
 }
 
+// CronJobs returns the cronJobs endpoint for the client's namespace
+func (k *Client) CronJobs() batchv1beta1.CronJobInterface {
+	return k.BatchV1beta1().CronJobs(k.namespace)
+}
+
 // ReplicaSets returns the replicaSets endpoint for the client's namespace
 func (k *Client) ReplicaSets() extensionsv1beta1.ReplicaSetInterface {
 	return k.Extensions().ReplicaSets(k.namespace)
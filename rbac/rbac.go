@@ -0,0 +1,175 @@
+package rbac
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/viliproject/vili/session"
+	"github.com/viliproject/vili/util"
+)
+
+var policy *Policy
+
+// Role is a named set of actions that a user can perform in an environment
+type Role string
+
+// Role enum values
+const (
+	RoleViewer   Role = "viewer"
+	RoleDeployer Role = "deployer"
+	RoleAdmin    Role = "admin"
+)
+
+// Action is an operation that is guarded by the access policy
+type Action string
+
+// Action enum values
+const (
+	ActionView              Action = "view"
+	ActionRollout           Action = "rollout"
+	ActionReleaseDeploy     Action = "releaseDeploy"
+	ActionConfigMapEdit     Action = "configmapEdit"
+	ActionNodeState         Action = "nodeState"
+	ActionEnvironmentDelete Action = "environmentDelete"
+)
+
+var defaultRoles = map[Role][]Action{
+	RoleViewer: {
+		ActionView,
+	},
+	RoleDeployer: {
+		ActionView,
+		ActionRollout,
+		ActionReleaseDeploy,
+	},
+	RoleAdmin: {
+		ActionView,
+		ActionRollout,
+		ActionReleaseDeploy,
+		ActionConfigMapEdit,
+		ActionNodeState,
+		ActionEnvironmentDelete,
+	},
+}
+
+// Config is the rbac configuration
+type Config struct {
+	// Policy is a yaml or json policy document
+	Policy string
+}
+
+// Policy maps users and groups to roles per environment
+type Policy struct {
+	DefaultRole Role              `json:"defaultRole,omitempty"`
+	Roles       map[Role][]Action `json:"roles,omitempty"`
+	Bindings    []*Binding        `json:"bindings,omitempty"`
+}
+
+// Binding grants a role to a set of users and groups in a set of environments.
+// A binding without any environments applies to all environments.
+type Binding struct {
+	Role   Role     `json:"role"`
+	Envs   []string `json:"envs,omitempty"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Init parses the configured policy and sets it as the global policy
+func Init(c *Config) error {
+	p, err := ParsePolicy(c.Policy)
+	if err != nil {
+		return err
+	}
+	policy = p
+	return nil
+}
+
+// ParsePolicy parses the given policy document. An empty document results in
+// a policy that grants the admin role to every user, which matches the
+// behavior of vili before access control was introduced.
+func ParsePolicy(document string) (*Policy, error) {
+	p := new(Policy)
+	if strings.TrimSpace(document) == "" {
+		p.DefaultRole = RoleAdmin
+	} else if err := yaml.Unmarshal([]byte(document), p); err != nil {
+		return nil, fmt.Errorf("failed parsing rbac policy: %s", err)
+	}
+
+	roles := make(map[Role][]Action, len(defaultRoles)+len(p.Roles))
+	for role, actions := range defaultRoles {
+		roles[role] = actions
+	}
+	for role, actions := range p.Roles {
+		roles[role] = actions
+	}
+	p.Roles = roles
+
+	if p.DefaultRole != "" {
+		if _, ok := p.Roles[p.DefaultRole]; !ok {
+			return nil, fmt.Errorf("unknown default role %s", p.DefaultRole)
+		}
+	}
+	for _, binding := range p.Bindings {
+		if _, ok := p.Roles[binding.Role]; !ok {
+			return nil, fmt.Errorf("unknown role %s in binding", binding.Role)
+		}
+	}
+	return p, nil
+}
+
+// Can returns whether the user is allowed to perform the action in the given env
+func Can(user *session.User, env string, action Action) bool {
+	if policy == nil {
+		return true
+	}
+	return policy.Can(user, env, action)
+}
+
+// Can returns whether the user is allowed to perform the action in the given env
+func (p *Policy) Can(user *session.User, env string, action Action) bool {
+	if user == nil {
+		return false
+	}
+	for _, role := range p.RolesFor(user, env) {
+		for _, roleAction := range p.Roles[role] {
+			if roleAction == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RolesFor returns the roles that the user has in the given env
+func (p *Policy) RolesFor(user *session.User, env string) []Role {
+	roles := []Role{}
+	if p.DefaultRole != "" {
+		roles = append(roles, p.DefaultRole)
+	}
+	if user == nil {
+		return roles
+	}
+	for _, binding := range p.Bindings {
+		if binding.matches(user, env) {
+			roles = append(roles, binding.Role)
+		}
+	}
+	return roles
+}
+
+func (b *Binding) matches(user *session.User, env string) bool {
+	if len(b.Envs) > 0 && !util.NewStringSet(b.Envs).Contains(env) {
+		return false
+	}
+	if util.NewStringSet(b.Users).Contains(user.Username) {
+		return true
+	}
+	groups := util.NewStringSet(b.Groups)
+	for _, group := range user.Groups {
+		if groups.Contains(group) {
+			return true
+		}
+	}
+	return false
+}
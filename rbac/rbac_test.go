@@ -0,0 +1,66 @@
+package rbac_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/viliproject/vili/rbac"
+	"github.com/viliproject/vili/session"
+)
+
+const testPolicy = `
+defaultRole: viewer
+roles:
+  operator:
+  - view
+  - nodeState
+bindings:
+- role: admin
+  groups: [ops]
+- role: deployer
+  envs: [staging]
+  groups: [engineering]
+- role: deployer
+  users: [ci-bot]
+- role: operator
+  envs: [prod]
+  users: [oncall]
+`
+
+func TestEmptyPolicy(t *testing.T) {
+	policy, err := rbac.ParsePolicy("")
+	assert.NoError(t, err)
+	user := &session.User{Username: "someone"}
+	assert.True(t, policy.Can(user, "prod", rbac.ActionEnvironmentDelete))
+	assert.False(t, policy.Can(nil, "prod", rbac.ActionView))
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := rbac.ParsePolicy(testPolicy)
+	assert.NoError(t, err)
+
+	engineer := &session.User{Username: "eng", Groups: []string{"engineering"}}
+	assert.True(t, policy.Can(engineer, "staging", rbac.ActionRollout))
+	assert.True(t, policy.Can(engineer, "prod", rbac.ActionView))
+	assert.False(t, policy.Can(engineer, "prod", rbac.ActionRollout))
+
+	ops := &session.User{Username: "ops", Groups: []string{"engineering", "ops"}}
+	assert.True(t, policy.Can(ops, "prod", rbac.ActionConfigMapEdit))
+
+	bot := &session.User{Username: "ci-bot"}
+	assert.True(t, policy.Can(bot, "prod", rbac.ActionReleaseDeploy))
+	assert.False(t, policy.Can(bot, "prod", rbac.ActionNodeState))
+
+	oncall := &session.User{Username: "oncall"}
+	assert.True(t, policy.Can(oncall, "prod", rbac.ActionNodeState))
+	assert.False(t, policy.Can(oncall, "staging", rbac.ActionNodeState))
+	assert.False(t, policy.Can(oncall, "prod", rbac.ActionRollout))
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	_, err := rbac.ParsePolicy("bindings:\n- role: superuser\n  users: [root]\n")
+	assert.Error(t, err)
+	_, err = rbac.ParsePolicy("defaultRole: superuser\n")
+	assert.Error(t, err)
+}
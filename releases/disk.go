@@ -0,0 +1,180 @@
+package releases
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/types"
+)
+
+// watcherBufferSize is the number of events that are buffered for each
+// watcher of the disk store before events are dropped
+const watcherBufferSize = 100
+
+// DiskConfig is the disk release store configuration
+type DiskConfig struct {
+	Dir string
+}
+
+// InitDisk initializes the disk release store, which keeps every release in
+// a json file under Dir/<env>/. It is meant for single instance deployments,
+// since watchers are only notified of changes made by the same process.
+func InitDisk(c *DiskConfig) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	service = &diskService{
+		dir:      c.Dir,
+		watchers: map[string]map[chan *Event]bool{},
+	}
+	return nil
+}
+
+type diskService struct {
+	dir string
+
+	mutex    sync.Mutex
+	watchers map[string]map[chan *Event]bool
+}
+
+func (s *diskService) envDir(env string) string {
+	return filepath.Join(s.dir, url.PathEscape(env))
+}
+
+func (s *diskService) releasePath(env, name string) string {
+	return filepath.Join(s.envDir(env), url.PathEscape(name)+".json")
+}
+
+func (s *diskService) Get(env, name string) (*types.Release, error) {
+	release := new(types.Release)
+	data, err := ioutil.ReadFile(s.releasePath(env, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return release, nil
+		}
+		return nil, err
+	}
+	return release, json.Unmarshal(data, release)
+}
+
+func (s *diskService) List(env string) ([]*types.Release, error) {
+	files, err := ioutil.ReadDir(s.envDir(env))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*types.Release{}, nil
+		}
+		return nil, err
+	}
+	releases := []*types.Release{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		release, err := s.Get(env, name)
+		if err != nil {
+			log.WithError(err).Warn("error reading release file")
+			continue
+		}
+		releases = append(releases, normalize(name, release))
+	}
+	return sortByName(releases), nil
+}
+
+func (s *diskService) Set(release *types.Release) error {
+	data, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.envDir(release.TargetEnv), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first so that readers never see partial files
+	path := s.releasePath(release.TargetEnv, release.Name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	// watchers get their own copy, so that they do not see later changes
+	// made by the caller
+	releaseCopy := new(types.Release)
+	if err := json.Unmarshal(data, releaseCopy); err != nil {
+		return err
+	}
+	s.notify(release.TargetEnv, &Event{
+		Type:   EventModified,
+		Object: normalize(release.Name, releaseCopy),
+	})
+	return nil
+}
+
+func (s *diskService) Delete(env, name string) error {
+	err := os.Remove(s.releasePath(env, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.notify(env, &Event{
+		Type: EventDeleted,
+		Object: &types.Release{
+			Name: name,
+		},
+	})
+	return nil
+}
+
+func (s *diskService) Watch(env string, stop <-chan struct{}, eventsChan chan<- *Event) error {
+	watcher := make(chan *Event, watcherBufferSize)
+	s.mutex.Lock()
+	if s.watchers[env] == nil {
+		s.watchers[env] = map[chan *Event]bool{}
+	}
+	s.watchers[env][watcher] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.watchers[env], watcher)
+		s.mutex.Unlock()
+	}()
+
+	releases, err := s.List(env)
+	if err != nil {
+		return err
+	}
+	eventsChan <- &Event{
+		Type: EventInit,
+		List: releases,
+	}
+	for {
+		select {
+		case event := <-watcher:
+			eventsChan <- event
+		case <-stop:
+			return nil
+		case <-ExitingChan:
+			return nil
+		}
+	}
+}
+
+func (s *diskService) notify(env string, event *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for watcher := range s.watchers[env] {
+		select {
+		case watcher <- event:
+		default:
+			log.Warn("dropping release event for slow watcher")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package releases_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/viliproject/vili/releases"
+	"github.com/viliproject/vili/types"
+)
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "releases")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, releases.InitDisk(&releases.DiskConfig{Dir: dir}))
+
+	release, err := releases.Get("prod", "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, "", release.Name)
+
+	assert.NoError(t, releases.Set(&types.Release{TargetEnv: "prod", Name: "b/2"}))
+	assert.NoError(t, releases.Set(&types.Release{TargetEnv: "prod", Name: "a1", CreatedBy: "someone"}))
+	release, err = releases.Get("prod", "a1")
+	assert.NoError(t, err)
+	assert.Equal(t, "someone", release.CreatedBy)
+
+	list, err := releases.List("prod")
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "a1", list[0].Name)
+		assert.Equal(t, "b/2", list[1].Name)
+	}
+
+	assert.NoError(t, releases.Delete("prod", "a1"))
+	list, err = releases.List("prod")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestDiskStoreWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "releases")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, releases.InitDisk(&releases.DiskConfig{Dir: dir}))
+	assert.NoError(t, releases.Set(&types.Release{TargetEnv: "prod", Name: "r1"}))
+
+	eventsChan := make(chan *releases.Event)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- releases.Watch("prod", stop, eventsChan)
+	}()
+
+	event := receiveEvent(t, eventsChan)
+	assert.Equal(t, releases.EventInit, event.Type)
+	assert.Len(t, event.List, 1)
+
+	assert.NoError(t, releases.Set(&types.Release{TargetEnv: "prod", Name: "r2"}))
+	event = receiveEvent(t, eventsChan)
+	assert.Equal(t, releases.EventModified, event.Type)
+	assert.Equal(t, "r2", event.Object.Name)
+	assert.NotNil(t, event.Object.Rollouts)
+
+	assert.NoError(t, releases.Delete("prod", "r1"))
+	event = receiveEvent(t, eventsChan)
+	assert.Equal(t, releases.EventDeleted, event.Type)
+	assert.Equal(t, "r1", event.Object.Name)
+
+	close(stop)
+	assert.NoError(t, <-done)
+}
+
+func receiveEvent(t *testing.T, eventsChan chan *releases.Event) *releases.Event {
+	select {
+	case event := <-eventsChan:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for release event")
+		return nil
+	}
+}
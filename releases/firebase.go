@@ -0,0 +1,107 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/viliproject/vili/firebase"
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/types"
+)
+
+// InitFirebase initializes the firebase release store. The firebase client
+// must be initialized separately.
+func InitFirebase() {
+	service = &firebaseService{}
+}
+
+type firebaseService struct{}
+
+func (s *firebaseService) Get(env, name string) (*types.Release, error) {
+	release := new(types.Release)
+	return release, firebase.Database().Child("releases").Child(env).Child(name).Value(release)
+}
+
+func (s *firebaseService) List(env string) ([]*types.Release, error) {
+	releaseMap := map[string]*types.Release{}
+	err := firebase.Database().Child("releases").Child(env).Value(&releaseMap)
+	if err != nil {
+		return nil, err
+	}
+	releases := []*types.Release{}
+	for name, release := range releaseMap {
+		releases = append(releases, normalize(name, release))
+	}
+	return sortByName(releases), nil
+}
+
+func (s *firebaseService) Set(release *types.Release) error {
+	return firebase.Database().Child("releases").Child(release.TargetEnv).Child(release.Name).Set(release)
+}
+
+func (s *firebaseService) Delete(env, name string) error {
+	return firebase.Database().Child("releases").Child(env).Child(name).Remove()
+}
+
+func (s *firebaseService) Watch(env string, stop <-chan struct{}, eventsChan chan<- *Event) error {
+	firebaseEventsChan := make(chan firebase.Event)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for firebaseEvent := range firebaseEventsChan {
+			if event := getFirebaseReleaseEvent(firebaseEvent); event != nil {
+				eventsChan <- event
+			}
+		}
+	}()
+	err := firebase.Watch(fmt.Sprintf("/releases/%s", env), firebaseEventsChan, stop)
+	close(firebaseEventsChan)
+	<-done
+	return err
+}
+
+func getFirebaseReleaseEvent(firebaseEvent firebase.Event) *Event {
+	if firebaseEvent.Type != "put" {
+		return nil
+	}
+	data, _ := json.Marshal(firebaseEvent.Data)
+	if firebaseEvent.Path == "/" {
+		releaseMap := map[string]*types.Release{}
+		err := json.Unmarshal(data, &releaseMap)
+		if err != nil {
+			log.WithError(err).Warn("error parsing releases json")
+			return nil
+		}
+		releases := []*types.Release{}
+		for name, release := range releaseMap {
+			releases = append(releases, normalize(name, release))
+		}
+		return &Event{
+			Type: EventInit,
+			List: sortByName(releases),
+		}
+	}
+	pathSlice := strings.Split(strings.TrimPrefix(firebaseEvent.Path, "/"), "/")
+	if len(pathSlice) != 1 {
+		return nil
+	}
+	if firebaseEvent.Data == nil {
+		return &Event{
+			Type: EventDeleted,
+			Object: &types.Release{
+				Name: pathSlice[0],
+			},
+		}
+	}
+	release := new(types.Release)
+	err := json.Unmarshal(data, release)
+	if err != nil {
+		log.WithError(err).Warn("error parsing release json")
+		return nil
+	}
+	return &Event{
+		Type:   EventModified,
+		Object: normalize(pathSlice[0], release),
+	}
+}
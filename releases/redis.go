@@ -0,0 +1,145 @@
+package releases
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/viliproject/vili/log"
+	"github.com/viliproject/vili/redis"
+	"github.com/viliproject/vili/types"
+)
+
+// InitRedis initializes the redis release store. Releases are stored in a
+// hash per environment, and changes are published to a channel per
+// environment so that every vili instance can notify its watchers.
+func InitRedis() {
+	service = &redisService{}
+}
+
+type redisService struct{}
+
+func redisReleasesKey(env string) string {
+	return fmt.Sprintf("releases:%s", env)
+}
+
+func redisReleaseEventsChannel(env string) string {
+	return fmt.Sprintf("releases:%s:events", env)
+}
+
+func (s *redisService) Get(env, name string) (*types.Release, error) {
+	release := new(types.Release)
+	data, err := redis.GetClient().HGet(redisReleasesKey(env), name).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return release, nil
+		}
+		return nil, err
+	}
+	return release, json.Unmarshal([]byte(data), release)
+}
+
+func (s *redisService) List(env string) ([]*types.Release, error) {
+	values, err := redis.GetClient().HGetAllMap(redisReleasesKey(env)).Result()
+	if err != nil {
+		return nil, err
+	}
+	releases := []*types.Release{}
+	for name, data := range values {
+		release := new(types.Release)
+		if err := json.Unmarshal([]byte(data), release); err != nil {
+			log.WithError(err).Warn("error parsing release json")
+			continue
+		}
+		releases = append(releases, normalize(name, release))
+	}
+	return sortByName(releases), nil
+}
+
+func (s *redisService) Set(release *types.Release) error {
+	data, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+	err = redis.GetClient().HSet(redisReleasesKey(release.TargetEnv), release.Name, string(data)).Err()
+	if err != nil {
+		return err
+	}
+	return s.publish(release.TargetEnv, &Event{
+		Type:   EventModified,
+		Object: release,
+	})
+}
+
+func (s *redisService) Delete(env, name string) error {
+	err := redis.GetClient().HDel(redisReleasesKey(env), name).Err()
+	if err != nil {
+		return err
+	}
+	return s.publish(env, &Event{
+		Type: EventDeleted,
+		Object: &types.Release{
+			Name: name,
+		},
+	})
+}
+
+func (s *redisService) publish(env string, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return redis.GetClient().Publish(redisReleaseEventsChannel(env), string(data)).Err()
+}
+
+func (s *redisService) Watch(env string, stop <-chan struct{}, eventsChan chan<- *Event) error {
+	// subscribe before listing the releases so that no changes are missed
+	pubsub, err := redis.GetClient().Subscribe(redisReleaseEventsChannel(env))
+	if err != nil {
+		return err
+	}
+	releases, err := s.List(env)
+	if err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		eventsChan <- &Event{
+			Type: EventInit,
+			List: releases,
+		}
+		for {
+			message, err := pubsub.ReceiveMessage()
+			if err != nil {
+				// the pubsub connection was closed
+				return
+			}
+			event := new(Event)
+			if err := json.Unmarshal([]byte(message.Payload), event); err != nil {
+				log.WithError(err).Warn("error parsing release event json")
+				continue
+			}
+			if event.Object != nil {
+				normalize(event.Object.Name, event.Object)
+			}
+			select {
+			case eventsChan <- event:
+			case <-stop:
+				return
+			case <-ExitingChan:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-stop:
+	case <-ExitingChan:
+	}
+	err = pubsub.Close()
+	<-done
+	return err
+}
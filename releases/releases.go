@@ -0,0 +1,89 @@
+package releases
+
+import (
+	"sort"
+
+	"github.com/viliproject/vili/types"
+)
+
+var (
+	service Service
+
+	// ExitingChan is a flag indicating that the server is exiting
+	ExitingChan = make(chan struct{})
+)
+
+// Event types
+const (
+	EventInit     = "INIT"
+	EventModified = "MODIFIED"
+	EventDeleted  = "DELETED"
+)
+
+// Event represents a change to the releases of an environment. INIT events
+// contain the full list of releases, MODIFIED events the changed release and
+// DELETED events a release with only its name set.
+type Event struct {
+	Type   string           `json:"type"`
+	Object *types.Release   `json:"object"`
+	List   []*types.Release `json:"list"`
+}
+
+// Service is a store for releases, keyed by their target environment and name
+type Service interface {
+	Get(env, name string) (*types.Release, error)
+	List(env string) ([]*types.Release, error)
+	Set(release *types.Release) error
+	Delete(env, name string) error
+	Watch(env string, stop <-chan struct{}, eventsChan chan<- *Event) error
+}
+
+// Get returns the release with the given name. If the release does not exist,
+// a release with an empty name is returned.
+func Get(env, name string) (*types.Release, error) {
+	return service.Get(env, name)
+}
+
+// List returns all releases for the given environment, sorted by name
+func List(env string) ([]*types.Release, error) {
+	return service.List(env)
+}
+
+// Set creates or replaces the release
+func Set(release *types.Release) error {
+	return service.Set(release)
+}
+
+// Delete deletes the release with the given name
+func Delete(env, name string) error {
+	return service.Delete(env, name)
+}
+
+// Watch sends an INIT event with the releases for the given environment, and
+// then an event for every change until stop or ExitingChan is closed. The
+// events chan is not written to after Watch returns.
+func Watch(env string, stop <-chan struct{}, eventsChan chan<- *Event) error {
+	return service.Watch(env, stop, eventsChan)
+}
+
+// normalize fills in the fields that are omitted by some stores
+func normalize(name string, release *types.Release) *types.Release {
+	if release.Name == "" {
+		release.Name = name
+	}
+	if release.Rollouts == nil {
+		release.Rollouts = []*types.ReleaseRollout{}
+	}
+	return release
+}
+
+type byName []*types.Release
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func sortByName(releases []*types.Release) []*types.Release {
+	sort.Sort(byName(releases))
+	return releases
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,6 +45,40 @@ func slugFromBranch(branch string) string {
 	return strings.ToLower(strings.Replace(branch, "/", "-", -1))
 }
 
+// DockerTagMatchesBranch returns whether the docker image tag was built from
+// the branch. Docker registry tags are named <timestamp>-<revision>, so they
+// match every branch.
+func DockerTagMatchesBranch(tag, branch string) bool {
+	if _, ok := dockerService.(*RegistryService); ok {
+		return isRegistryTag(tag)
+	}
+	return tagMatchesBranch(tag, branch)
+}
+
+// BundleTagMatchesBranch returns whether the bundle tag was built from the
+// branch
+func BundleTagMatchesBranch(tag, branch string) bool {
+	return tagMatchesBranch(tag, branch)
+}
+
+// tagMatchesBranch returns whether the tag is named <branch slug>-<revision>
+func tagMatchesBranch(tag, branch string) bool {
+	sepIndex := strings.LastIndex(tag, "-")
+	return sepIndex != -1 && tag[:sepIndex] == slugFromBranch(branch)
+}
+
+// isRegistryTag returns whether the tag is listed for branches by the docker
+// registry service, which lists tags named <timestamp>-<revision> and tags
+// without a revision
+func isRegistryTag(tag string) bool {
+	sepIndex := strings.LastIndex(tag, "-")
+	if sepIndex == -1 {
+		return true
+	}
+	_, err := strconv.ParseInt(tag[:sepIndex], 10, 0)
+	return err == nil
+}
+
 func sortByLastModified(images []*Image) {
 	ps := &imageSorter{
 		images: images,
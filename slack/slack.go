@@ -236,6 +236,14 @@ func ListenForMessages(messageMap map[*regexp.Regexp]chan<- *Message) {
 	}
 }
 
+// Escape escapes the characters that slack uses for links and mentions, so
+// that untrusted text is posted as it is
+func Escape(text string) string {
+	return slackEscaper.Replace(text)
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
 func removeLinks(message string) string {
 	return slackLinkRegexp.ReplaceAllStringFunc(message, func(match string) string {
 		sepIndex := strings.LastIndex(match, "|")
@@ -84,6 +84,32 @@ func (s *gitService) Job(env, branch, name string) (Template, error) {
 	return Template(fileContent), nil
 }
 
+// CronJobs returns a list of cron jobs for the given environment
+func (s *gitService) CronJobs(env, branch string) ([]string, error) {
+	directoryContent, err := s.listDirectory(env, branch, "cronjobs")
+	if err != nil {
+		return nil, err
+	}
+	cronJobs := []string{}
+	for _, filePath := range directoryContent {
+		parts := strings.Split(filePath, ".")
+		if len(parts) != 2 || parts[1] != "yaml" {
+			continue
+		}
+		cronJobs = append(cronJobs, parts[0])
+	}
+	return cronJobs, nil
+}
+
+// CronJob returns a cron job for the given environment
+func (s *gitService) CronJob(env, branch, name string) (Template, error) {
+	fileContent, err := s.getContents(env, branch, "cronjobs/"+name+".yaml")
+	if err != nil {
+		return "", err
+	}
+	return Template(fileContent), nil
+}
+
 // Deployments returns a list of deployments for the given environment
 func (s *gitService) Deployments(env, branch string) ([]string, error) {
 	directoryContent, err := s.listDirectory(env, branch, "deployments")
@@ -0,0 +1,187 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// ParametersAnnotation is the annotation in which a template declares its
+// parameters, as a yaml or json list
+const ParametersAnnotation = "vili/parameters"
+
+// ParameterType is the type of a template parameter
+// It can be one of "string", "integer" or "boolean"
+type ParameterType string
+
+// ParameterType enum values
+const (
+	ParameterTypeString  ParameterType = "string"
+	ParameterTypeInteger ParameterType = "integer"
+	ParameterTypeBoolean ParameterType = "boolean"
+)
+
+var parameterNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Parameter is a parameter declared by a template. Values is the list of
+// allowed values, if it is not empty.
+type Parameter struct {
+	Name     string        `json:"name"`
+	Type     ParameterType `json:"type,omitempty"`
+	Default  string        `json:"default,omitempty"`
+	Required bool          `json:"required,omitempty"`
+	Values   []string      `json:"values,omitempty"`
+}
+
+// Parameters returns the parameters declared by the template
+func (t Template) Parameters() ([]*Parameter, error) {
+	object := new(struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	})
+	if err := t.Parse(object); err != nil {
+		// populate the template without values so that references to the
+		// parameters do not break the yaml
+		populated, err := t.Populate(map[string]string{})
+		if err != nil {
+			return nil, err
+		}
+		if err := populated.Parse(object); err != nil {
+			return nil, err
+		}
+	}
+	annotation := object.Metadata.Annotations[ParametersAnnotation]
+	if annotation == "" {
+		return nil, nil
+	}
+	parameters := []*Parameter{}
+	if err := Template(annotation).Parse(&parameters); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %s", ParametersAnnotation, err)
+	}
+	seen := map[string]bool{}
+	for _, parameter := range parameters {
+		if !parameterNameRegexp.MatchString(parameter.Name) {
+			return nil, fmt.Errorf("invalid parameter name %q", parameter.Name)
+		}
+		if seen[parameter.Name] {
+			return nil, fmt.Errorf("parameter %s is declared more than once", parameter.Name)
+		}
+		seen[parameter.Name] = true
+		if parameter.Type == "" {
+			parameter.Type = ParameterTypeString
+		}
+		if parameter.Default != "" {
+			if err := parameter.Validate(parameter.Default); err != nil {
+				return nil, fmt.Errorf("invalid default for parameter %s: %s", parameter.Name, err)
+			}
+		}
+	}
+	return parameters, nil
+}
+
+// PopulateParameters populates the template with the values of its
+// parameters. Unlike Populate, the values are not HTML escaped. String values
+// are quoted for yaml, so they are used as whole yaml values such as
+// `- {{.name}}`, while integer and boolean values are inserted as they are.
+func (t Template) PopulateParameters(parameters []*Parameter, values map[string]string) (Template, error) {
+	data := map[string]string{}
+	for _, parameter := range parameters {
+		value := values[parameter.Name]
+		if parameter.Type == ParameterTypeString || parameter.Type == "" {
+			quoted, err := json.Marshal(value)
+			if err != nil {
+				return Template(""), err
+			}
+			value = string(quoted)
+		}
+		data[parameter.Name] = value
+	}
+	temp, err := template.New("").Option("missingkey=zero").Parse(string(t))
+	if err != nil {
+		return Template(""), err
+	}
+	buf := new(bytes.Buffer)
+	if err := temp.Execute(buf, data); err != nil {
+		return Template(""), err
+	}
+	return Template(buf.String()), nil
+}
+
+// Validate checks that the value has the type of the parameter and is one of
+// its allowed values. Values may not contain control characters such as
+// newlines, as they are populated into yaml templates.
+func (p *Parameter) Validate(value string) error {
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%q contains control characters", value)
+	}
+	switch p.Type {
+	case ParameterTypeString, "":
+	case ParameterTypeInteger:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+	case ParameterTypeBoolean:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+	default:
+		return fmt.Errorf("unknown type %s", p.Type)
+	}
+	if len(p.Values) == 0 {
+		return nil
+	}
+	for _, allowed := range p.Values {
+		if value == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", value, strings.Join(p.Values, ", "))
+}
+
+// ResolveParameters validates the values given for the parameters and returns
+// the value of every parameter, using the defaults for the parameters that
+// were not given. The error lists every invalid value.
+func ResolveParameters(parameters []*Parameter, values map[string]string) (map[string]string, error) {
+	resolved := map[string]string{}
+	problems := []string{}
+	declared := map[string]bool{}
+	for _, parameter := range parameters {
+		declared[parameter.Name] = true
+		value, ok := values[parameter.Name]
+		if !ok || value == "" {
+			if parameter.Required {
+				problems = append(problems, fmt.Sprintf("parameter %s is required", parameter.Name))
+				continue
+			}
+			value = parameter.Default
+		}
+		if value != "" {
+			if err := parameter.Validate(value); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid parameter %s: %s", parameter.Name, err))
+				continue
+			}
+		}
+		resolved[parameter.Name] = value
+	}
+	unknown := []string{}
+	for name := range values {
+		if !declared[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown parameter %s", name))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return resolved, nil
+}
@@ -14,6 +14,8 @@ var service Service
 type Service interface {
 	Jobs(env, branch string) ([]string, error)
 	Job(env, branch, name string) (Template, error)
+	CronJobs(env, branch string) ([]string, error)
+	CronJob(env, branch, name string) (Template, error)
 	Deployments(env, branch string) ([]string, error)
 	Deployment(env, branch, name string) (Template, error)
 	Functions(env, branch string) ([]string, error)
@@ -34,6 +36,16 @@ func Job(env, branch, name string) (Template, error) {
 	return service.Job(env, branch, name)
 }
 
+// CronJobs returns a list of cron jobs for the given environment
+func CronJobs(env, branch string) ([]string, error) {
+	return service.CronJobs(env, branch)
+}
+
+// CronJob returns a cron job for the given environment
+func CronJob(env, branch, name string) (Template, error) {
+	return service.CronJob(env, branch, name)
+}
+
 // Deployments returns a list of deployments for the given environment
 func Deployments(env, branch string) ([]string, error) {
 	return service.Deployments(env, branch)
@@ -9,7 +9,36 @@ import (
 )
 
 const (
-	testTemplate templates.Template = `KEY1 = {VAR1}`
+	testTemplate templates.Template = `KEY1 = {{.VAR1}}`
+
+	testJobTemplate templates.Template = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  annotations:
+    vili/parameters: |
+      - name: date
+        required: true
+      - name: limit
+        type: integer
+        default: "100"
+      - name: mode
+        values: [dry, apply]
+        default: dry
+spec:
+  parallelism: {{.limit}}
+`
+
+	testLiteralJobTemplate templates.Template = `
+apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    spec:
+      containers:
+      - name: render
+        args: ["render", "--format", "{{ .Name }"]
+`
 )
 
 var testVariables = map[string]string{
@@ -17,10 +46,45 @@ var testVariables = map[string]string{
 }
 
 func TestParsing(t *testing.T) {
-	populated1, invalid1 := testTemplate.Populate(nil)
+	populated1, err1 := testTemplate.Populate(nil)
 	assert.Equal(t, `KEY1 = `, string(populated1))
-	assert.Equal(t, true, invalid1)
-	populated2, invalid2 := testTemplate.Populate(testVariables)
+	assert.Nil(t, err1)
+	populated2, err2 := testTemplate.Populate(testVariables)
 	assert.Equal(t, `KEY1 = VALUE1`, string(populated2))
-	assert.Equal(t, false, invalid2)
+	assert.Nil(t, err2)
+}
+
+func TestParameters(t *testing.T) {
+	parameters, err := testJobTemplate.Parameters()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(parameters))
+	assert.Equal(t, templates.ParameterTypeString, parameters[0].Type)
+
+	values, err := templates.ResolveParameters(parameters, map[string]string{"date": "2018-01-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"date": "2018-01-01", "limit": "100", "mode": "dry"}, values)
+
+	_, err = templates.ResolveParameters(parameters, map[string]string{"limit": "many", "mode": "force", "other": "1"})
+	assert.EqualError(t, err, `parameter date is required; invalid parameter limit: "many" is not an integer; invalid parameter mode: "force" is not one of dry, apply; unknown parameter other`)
+
+	_, err = templates.ResolveParameters(parameters, map[string]string{"date": "2018-01-01\nkind: Pod"})
+	assert.EqualError(t, err, `invalid parameter date: "2018-01-01\nkind: Pod" contains control characters`)
+}
+
+func TestParametersWithoutDeclaration(t *testing.T) {
+	parameters, err := testLiteralJobTemplate.Parameters()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(parameters))
+}
+
+func TestPopulateParameters(t *testing.T) {
+	parameters, err := testJobTemplate.Parameters()
+	assert.Nil(t, err)
+	template := templates.Template("date: {{.date}}\nlimit: {{.limit}}\nmode: {{.mode}}\n")
+	populated, err := template.PopulateParameters(parameters, map[string]string{"date": `a&b "c"`, "limit": "100"})
+	assert.Nil(t, err)
+
+	values := map[string]interface{}{}
+	assert.Nil(t, populated.Parse(&values))
+	assert.Equal(t, map[string]interface{}{"date": `a&b "c"`, "limit": float64(100), "mode": ""}, values)
 }
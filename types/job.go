@@ -0,0 +1,25 @@
+package types
+
+// JobRunStatus is the status of a job run
+// It can be one of "running", "succeeded", "failed" or "cancelled"
+type JobRunStatus string
+
+// JobRunStatus enum values
+const (
+	JobRunStatusRunning   JobRunStatus = "running"
+	JobRunStatusSucceeded JobRunStatus = "succeeded"
+	JobRunStatusFailed    JobRunStatus = "failed"
+	JobRunStatusCancelled JobRunStatus = "cancelled"
+)
+
+// JobConcurrencyPolicy is how a job run is handled when the job is already
+// running
+// It can be one of "allow", "forbid" or "replace"
+type JobConcurrencyPolicy string
+
+// JobConcurrencyPolicy enum values
+const (
+	JobConcurrencyPolicyAllow   JobConcurrencyPolicy = "allow"
+	JobConcurrencyPolicyForbid  JobConcurrencyPolicy = "forbid"
+	JobConcurrencyPolicyReplace JobConcurrencyPolicy = "replace"
+)
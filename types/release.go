@@ -11,19 +11,62 @@ type Release struct {
 	CreatedAt time.Time         `json:"createdAt"`
 	CreatedBy string            `json:"createdBy"`
 	Rollouts  []*ReleaseRollout `json:"rollouts"`
+	Notes     []*ReleaseNote    `json:"notes,omitempty"`
 }
 
-// ReleaseWave represents a wave of a release
+// ReleaseWave represents a wave of a release. A wave with PauseBefore waits
+// for approval before it is deployed. A wave with ContinueOnError does not
+// stop the rollout if it fails. Timeout is a duration such as "15m" after
+// which the wave fails if it has not finished deploying.
 type ReleaseWave struct {
-	Targets []*ReleaseTarget `json:"targets"`
+	Targets         []*ReleaseTarget `json:"targets"`
+	PauseBefore     bool             `json:"pauseBefore,omitempty"`
+	ContinueOnError bool             `json:"continueOnError,omitempty"`
+	Timeout         string           `json:"timeout,omitempty"`
 }
 
-// ReleaseTarget represents a wave of a release
+// ReleaseTarget represents a wave of a release. Params are the parameters
+// of action and job targets. FailOn fails a job target if a field of the
+// result of the job run has the given value.
 type ReleaseTarget struct {
 	Type   ReleaseTargetType `json:"type"`
 	Name   string            `json:"name"`
 	Branch string            `json:"branch,omitempty"`
 	Tag    string            `json:"tag,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	FailOn map[string]string `json:"failOn,omitempty"`
+}
+
+// ReleaseTargetResult is the result of deploying a release target. Message
+// describes the result of actions.
+type ReleaseTargetResult struct {
+	Type    ReleaseTargetType `json:"type"`
+	Name    string            `json:"name"`
+	Status  RolloutStatus     `json:"status"`
+	Message string            `json:"message,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// ReleaseNote lists the commits between the revision of a target that was
+// deployed when the release was created and the revision in the release.
+// Error is set if the commits could not be listed.
+type ReleaseNote struct {
+	Type         ReleaseTargetType    `json:"type"`
+	Name         string               `json:"name"`
+	FromRevision string               `json:"fromRevision,omitempty"`
+	ToRevision   string               `json:"toRevision,omitempty"`
+	Commits      []*ReleaseNoteCommit `json:"commits"`
+	Error        string               `json:"error,omitempty"`
+}
+
+// ReleaseNoteCommit represents a commit in the release notes
+type ReleaseNoteCommit struct {
+	SHA              string `json:"sha"`
+	Message          string `json:"message"`
+	Author           string `json:"author"`
+	URL              string `json:"url,omitempty"`
+	PullRequest      int    `json:"pullRequest,omitempty"`
+	PullRequestTitle string `json:"pullRequestTitle,omitempty"`
 }
 
 // ReleaseRollout represents a rollout of a release
@@ -34,32 +77,48 @@ type ReleaseRollout struct {
 	RolloutBy string                `json:"rolloutBy"`
 	Status    RolloutStatus         `json:"status"`
 	Waves     []*ReleaseRolloutWave `json:"waves"`
+	Error     string                `json:"error,omitempty"`
+	// Rollback is set for rollouts that revert this release to the release
+	// RollbackTo, by deploying RollbackWaves instead of the release waves
+	Rollback      bool           `json:"rollback,omitempty"`
+	RollbackTo    string         `json:"rollbackTo,omitempty"`
+	RollbackWaves []*ReleaseWave `json:"rollbackWaves,omitempty"`
 }
 
 // ReleaseRolloutWave represents a wave of a release rollout
 type ReleaseRolloutWave struct {
-	Status RolloutStatus `json:"status"`
+	Status     RolloutStatus `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	ApprovedBy string        `json:"approvedBy,omitempty"`
+	ApprovedAt *time.Time    `json:"approvedAt,omitempty"`
+	// Results are the results of the targets of the wave, in order
+	Results []*ReleaseTargetResult `json:"results,omitempty"`
 }
 
 // RolloutStatus is the status of the rollout
-// It can be one of "new", "deploying", "deployed", "failed"
+// It can be one of "new", "waiting", "deploying", "deployed", "failed", "rolledback", "aborted"
 type RolloutStatus string
 
 // RolloutStatus enum values
 const (
-	RolloutStatusNew       RolloutStatus = "new"
-	RolloutStatusDeploying RolloutStatus = "deploying"
-	RolloutStatusDeployed  RolloutStatus = "deployed"
-	RolloutStatusFailed    RolloutStatus = "failed"
+	RolloutStatusNew        RolloutStatus = "new"
+	RolloutStatusWaiting    RolloutStatus = "waiting"
+	RolloutStatusDeploying  RolloutStatus = "deploying"
+	RolloutStatusDeployed   RolloutStatus = "deployed"
+	RolloutStatusFailed     RolloutStatus = "failed"
+	RolloutStatusRolledBack RolloutStatus = "rolledback"
+	RolloutStatusAborted    RolloutStatus = "aborted"
 )
 
 // ReleaseTargetType is the type of the release target
-// It can be one of "action", "job" or "app"
+// It can be one of "action", "job", "app", "function" or "configmap"
 type ReleaseTargetType string
 
 // ReleaseTargetType enum values
 const (
-	ReleaseTargetTypeAction ReleaseTargetType = "action"
-	ReleaseTargetTypeJob    ReleaseTargetType = "job"
-	ReleaseTargetTypeApp    ReleaseTargetType = "app"
+	ReleaseTargetTypeAction    ReleaseTargetType = "action"
+	ReleaseTargetTypeJob       ReleaseTargetType = "job"
+	ReleaseTargetTypeApp       ReleaseTargetType = "app"
+	ReleaseTargetTypeFunction  ReleaseTargetType = "function"
+	ReleaseTargetTypeConfigMap ReleaseTargetType = "configmap"
 )